@@ -1,14 +1,19 @@
 module github.com/SmartEnergyPlatform/permission-search
 
+go 1.16
+
 require (
 	github.com/JumboInteractiveLimited/jsonpath v0.0.0-20180321012328-6fcdcc9066b5
 	github.com/SmartEnergyPlatform/amqp-wrapper-lib v0.0.0-20181018071408-32e07d9d89bb
 	github.com/SmartEnergyPlatform/jwt-http-router v0.0.0-20190111100649-8c1c5434af3c
 	github.com/SmartEnergyPlatform/util v0.0.0-20181018070938-b26ca656886c
 	github.com/dgrijalva/jwt-go v3.1.0+incompatible
+	github.com/klauspost/compress v1.15.9 // indirect
 	github.com/mailru/easyjson v0.0.0-20180323154445-8b799c424f57
-	github.com/olivere/elastic v6.1.14+incompatible
+	github.com/olivere/elastic v6.2.37+incompatible
+	github.com/pierrec/lz4/v4 v4.1.15 // indirect
 	github.com/pkg/errors v0.8.0
+	github.com/segmentio/kafka-go v0.4.47
 	github.com/streadway/amqp v0.0.0-20180307223721-d27ae102b889
 	gopkg.in/mgo.v2 v2.0.0-20160818020120-3f83fa500528
 )
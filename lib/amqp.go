@@ -0,0 +1,47 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package lib
+
+import (
+	"github.com/SmartEnergyPlatform/amqp-wrapper-lib"
+)
+
+// AmqpTransport uses one fanout exchange per topic and one durable queue per consumer group;
+// failed messages are rejected and requeued
+type AmqpTransport struct {
+	conn *amqp_wrapper_lib.Connection
+}
+
+// NewAmqpTransport connects to the broker and declares the exchanges of the topics
+func NewAmqpTransport(url string, topics []string, reconnectTimeout int64) (*AmqpTransport, error) {
+	conn, err := amqp_wrapper_lib.Init(url, topics, reconnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &AmqpTransport{conn: conn}, nil
+}
+
+func (this *AmqpTransport) Subscribe(group string, topic string, handler TransportHandler) error {
+	return this.conn.Consume(group, topic, amqp_wrapper_lib.ConsumerFunc(handler))
+}
+
+func (this *AmqpTransport) Publish(topic string, payload []byte) error {
+	return this.conn.Publish(topic, payload)
+}
+
+func (this *AmqpTransport) Close() {
+	this.conn.Close()
+}
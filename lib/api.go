@@ -17,8 +17,11 @@
 package lib
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"encoding/json"
 
@@ -101,12 +104,7 @@ func getRoutes() (router *jwt_http_router.Router) {
 		kind := ps.ByName("resource_kind")
 		right := ps.ByName("right")
 		query := ps.ByName("query")
-		list, err := SearchListAll(kind, query, jwt.UserId, jwt.RealmAccess.Roles, right)
-		if err != nil {
-			http.Error(res, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		response.To(res).Json(list)
+		respondQueryAll(res, r, kind, jwt, QueryRequest{Rights: right, Text: query, TextOptions: textOptionsFromUrl(r.URL.Query())})
 	})
 
 	router.GET("/jwt/select/:resource_kind/:field/:value/:right", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
@@ -114,13 +112,7 @@ func getRoutes() (router *jwt_http_router.Router) {
 		right := ps.ByName("right")
 		field := ps.ByName("field")
 		value := ps.ByName("value")
-		list, err := SelectByFieldAll(kind, field, value, jwt.UserId, jwt.RealmAccess.Roles, right)
-		if err != nil {
-			log.Println("ERROR:", err)
-			http.Error(res, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		response.To(res).Json(list)
+		respondQueryAll(res, r, kind, jwt, QueryRequest{Rights: right, Selection: selectByFieldSelection(field, value)})
 	})
 
 	router.GET("/jwt/select/:resource_kind/:field/:value/:right/:limit/:offset/:orderfeature/:direction", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
@@ -132,13 +124,7 @@ func getRoutes() (router *jwt_http_router.Router) {
 		offset := ps.ByName("offset")
 		orderfeature := ps.ByName("orderfeature")
 		direction := ps.ByName("direction")
-		list, err := SelectByFieldOrdered(kind, field, value, jwt.UserId, jwt.RealmAccess.Roles, right, limit, offset, orderfeature, direction == "asc")
-		if err != nil {
-			log.Println("ERROR:", err)
-			http.Error(res, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		response.To(res).Json(list)
+		respondQuery(res, r, kind, jwt, QueryRequest{Rights: right, Selection: selectByFieldSelection(field, value), Sort: sortBy(orderfeature, direction == "asc")}, limit, offset)
 	})
 
 	router.GET("/jwt/search/:resource_kind/:query/:right/:limit/:offset", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
@@ -147,12 +133,7 @@ func getRoutes() (router *jwt_http_router.Router) {
 		query := ps.ByName("query")
 		limit := ps.ByName("limit")
 		offset := ps.ByName("offset")
-		list, err := SearchList(kind, query, jwt.UserId, jwt.RealmAccess.Roles, right, limit, offset)
-		if err != nil {
-			http.Error(res, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		response.To(res).Json(list)
+		respondQuery(res, r, kind, jwt, QueryRequest{Rights: right, Text: query}, limit, offset)
 	})
 
 	router.GET("/jwt/search/:resource_kind/:query/:right/:limit/:offset/:orderfeature", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
@@ -162,12 +143,7 @@ func getRoutes() (router *jwt_http_router.Router) {
 		limit := ps.ByName("limit")
 		offset := ps.ByName("offset")
 		order := ps.ByName("orderfeature")
-		list, err := SearchOrderedList(kind, query, jwt.UserId, jwt.RealmAccess.Roles, right, order, true, limit, offset)
-		if err != nil {
-			http.Error(res, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		response.To(res).Json(list)
+		respondQuery(res, r, kind, jwt, QueryRequest{Rights: right, Text: query, Sort: sortBy(order, true)}, limit, offset)
 	})
 
 	router.GET("/jwt/search/:resource_kind/:query/:right/:limit/:offset/:orderfeature/asc", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
@@ -177,12 +153,7 @@ func getRoutes() (router *jwt_http_router.Router) {
 		limit := ps.ByName("limit")
 		offset := ps.ByName("offset")
 		order := ps.ByName("orderfeature")
-		list, err := SearchOrderedList(kind, query, jwt.UserId, jwt.RealmAccess.Roles, right, order, true, limit, offset)
-		if err != nil {
-			http.Error(res, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		response.To(res).Json(list)
+		respondQuery(res, r, kind, jwt, QueryRequest{Rights: right, Text: query, Sort: sortBy(order, true)}, limit, offset)
 	})
 
 	router.GET("/jwt/search/:resource_kind/:query/:right/:limit/:offset/:orderfeature/desc", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
@@ -192,24 +163,14 @@ func getRoutes() (router *jwt_http_router.Router) {
 		limit := ps.ByName("limit")
 		offset := ps.ByName("offset")
 		order := ps.ByName("orderfeature")
-		list, err := SearchOrderedList(kind, query, jwt.UserId, jwt.RealmAccess.Roles, right, order, false, limit, offset)
-		if err != nil {
-			http.Error(res, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		response.To(res).Json(list)
+		respondQuery(res, r, kind, jwt, QueryRequest{Rights: right, Text: query, Sort: sortBy(order, false)}, limit, offset)
 	})
 
 	//TODO: add limit/offset variant
 	router.GET("/jwt/list/:resource_kind/:right", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
 		kind := ps.ByName("resource_kind")
 		right := ps.ByName("right")
-		list, err := GetFullListForUserOrGroup(kind, jwt.UserId, jwt.RealmAccess.Roles, right)
-		if err != nil {
-			http.Error(res, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		response.To(res).Json(list)
+		respondQueryAll(res, r, kind, jwt, QueryRequest{Rights: right})
 	})
 
 	router.GET("/jwt/list/:resource_kind/:right/:limit/:offset", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
@@ -217,12 +178,7 @@ func getRoutes() (router *jwt_http_router.Router) {
 		right := ps.ByName("right")
 		limit := ps.ByName("limit")
 		offset := ps.ByName("offset")
-		list, err := GetListForUserOrGroup(kind, jwt.UserId, jwt.RealmAccess.Roles, right, limit, offset)
-		if err != nil {
-			http.Error(res, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		response.To(res).Json(list)
+		respondQuery(res, r, kind, jwt, QueryRequest{Rights: right}, limit, offset)
 	})
 
 	router.GET("/jwt/list/:resource_kind/:right/:limit/:offset/:orderfeature/asc", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
@@ -231,12 +187,7 @@ func getRoutes() (router *jwt_http_router.Router) {
 		limit := ps.ByName("limit")
 		offset := ps.ByName("offset")
 		orderfeature := ps.ByName("orderfeature")
-		list, err := GetOrderedListForUserOrGroup(kind, jwt.UserId, jwt.RealmAccess.Roles, right, limit, offset, orderfeature, true)
-		if err != nil {
-			http.Error(res, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		response.To(res).Json(list)
+		respondQuery(res, r, kind, jwt, QueryRequest{Rights: right, Sort: sortBy(orderfeature, true)}, limit, offset)
 	})
 
 	router.GET("/jwt/list/:resource_kind/:right/:limit/:offset/:orderfeature/desc", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
@@ -245,12 +196,104 @@ func getRoutes() (router *jwt_http_router.Router) {
 		limit := ps.ByName("limit")
 		offset := ps.ByName("offset")
 		orderfeature := ps.ByName("orderfeature")
-		list, err := GetOrderedListForUserOrGroup(kind, jwt.UserId, jwt.RealmAccess.Roles, right, limit, offset, orderfeature, false)
+		respondQuery(res, r, kind, jwt, QueryRequest{Rights: right, Sort: sortBy(orderfeature, false)}, limit, offset)
+	})
+
+	router.GET("/v2/query/:resource_kind", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
+		kind := ps.ByName("resource_kind")
+		request, err := queryRequestFromUrl(kind, r.URL.Query())
 		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		respondQueryPage(res, r, kind, jwt, request, true)
+	})
+
+	router.POST("/v2/query/:resource_kind", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
+		kind := ps.ByName("resource_kind")
+		request := QueryRequest{}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		respondQueryPage(res, r, kind, jwt, request, true)
+	})
+
+	router.GET("/jwt/suggest/:resource_kind/:right", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
+		kind := ps.ByName("resource_kind")
+		right := ps.ByName("right")
+		size := 0
+		if sizeStr := r.URL.Query().Get("size"); sizeStr != "" {
+			var err error
+			size, err = strconv.Atoi(sizeStr)
+			if err != nil {
+				http.Error(res, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if err := validateSuggest(kind, right, size); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err := Suggest(kind, jwt.UserId, jwt.RealmAccess.Roles, right, r.URL.Query().Get("text"), size)
+		if err != nil {
+			log.Println("ERROR:", err)
 			http.Error(res, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		response.To(res).Json(list)
+		response.To(res).Json(result)
+	})
+
+	router.POST("/v2/search", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
+		request := KindSearchRequest{}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = request.Validate()
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err := SearchKinds(jwt.UserId, jwt.RealmAccess.Roles, request)
+		if err != nil {
+			log.Println("ERROR:", err)
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response.To(res).Json(result)
+	})
+
+	router.POST("/jwt/facets/:resource_kind/:right", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
+		kind := ps.ByName("resource_kind")
+		right := ps.ByName("right")
+		request := FacetRequest{}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if request.Selection != nil {
+			selection := request.Selection.Resolve(jwt)
+			request.Selection = &selection
+		}
+		err = request.Validate(kind)
+		if err == nil {
+			err = validateRights(right)
+		}
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err := GetFacets(kind, jwt.UserId, jwt.RealmAccess.Roles, right, request)
+		if err != nil {
+			log.Println("ERROR:", err)
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response.To(res).Json(result)
 	})
 
 	router.GET("/jwt/check/:resource_kind/:resource_id/:right", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
@@ -308,13 +351,7 @@ func getRoutes() (router *jwt_http_router.Router) {
 			http.Error(res, err.Error(), http.StatusBadRequest)
 			return
 		}
-		result, err := GetListFromIds(kind, ids, jwt.UserId, jwt.RealmAccess.Roles, right)
-		if err != nil {
-			log.Println("ERROR:", ids, err)
-			http.Error(res, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		response.To(res).Json(result)
+		respondQueryPage(res, r, kind, jwt, QueryRequest{Rights: right, Ids: ids, Limit: len(ids)}, wantsEnvelope(r))
 	})
 
 	router.POST("/ids/select/:resource_kind/:right/:limit/:offset/:orderfeature/:direction", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
@@ -331,13 +368,7 @@ func getRoutes() (router *jwt_http_router.Router) {
 			http.Error(res, err.Error(), http.StatusBadRequest)
 			return
 		}
-		result, err := GetListFromIdsOrdered(kind, ids, jwt.UserId, jwt.RealmAccess.Roles, right, limit, offset, orderfeature, direction == "asc")
-		if err != nil {
-			log.Println("ERROR:", ids, err)
-			http.Error(res, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		response.To(res).Json(result)
+		respondQuery(res, r, kind, jwt, QueryRequest{Rights: right, Ids: ids, Sort: sortBy(orderfeature, direction == "asc")}, limit, offset)
 	})
 
 	router.GET("/user/list/:user/:resource_kind/:right", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
@@ -395,6 +426,14 @@ func getRoutes() (router *jwt_http_router.Router) {
 	})
 
 	router.GET("/export", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
+		if wantsNdjson(r) {
+			stream := newNdjsonStream(res)
+			err := StreamExport(r.Context(), func(line ExportLine) error {
+				return stream.write(line)
+			})
+			stream.finish(r.Context(), err)
+			return
+		}
 		exports, err := Export()
 		if err != nil {
 			http.Error(res, err.Error(), http.StatusInternalServerError)
@@ -419,33 +458,46 @@ func getRoutes() (router *jwt_http_router.Router) {
 		response.To(res).Json(ok)
 	})
 
-	router.POST("/jwt/search/:resource_kind/:query/:right/:limit/:offset/:orderfeature/asc", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
-		kind := ps.ByName("resource_kind")
-		right := ps.ByName("right")
-		query := ps.ByName("query")
-		limit := ps.ByName("limit")
-		offset := ps.ByName("offset")
-		order := ps.ByName("orderfeature")
-		selection := Selection{}
-		err := json.NewDecoder(r.Body).Decode(&selection)
-		if err != nil {
-			http.Error(res, err.Error(), http.StatusBadRequest)
+	router.GET("/stale-events", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
+		if !requireAdmin(res, jwt) {
 			return
 		}
-		selectionFilter, err := selection.GetFilter(jwt)
+		response.To(res).Json(StaleEvents())
+	})
+
+	router.GET("/deadletters", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
+		if !requireAdmin(res, jwt) {
+			return
+		}
+		limit, offset, err := parseLimitOffset(queryParam(r, "limit", "0"), queryParam(r, "offset", "0"))
 		if err != nil {
 			http.Error(res, err.Error(), http.StatusBadRequest)
 			return
 		}
-		list, err := SearchOrderedListWithSelection(kind, query, jwt.UserId, jwt.RealmAccess.Roles, right, order, true, limit, offset, selectionFilter)
+		letters, err := ListDeadLetters(limit, offset)
 		if err != nil {
+			log.Println("ERROR:", err)
 			http.Error(res, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		response.To(res).Json(list)
+		response.To(res).Json(letters)
 	})
 
-	router.POST("/jwt/search/:resource_kind/:query/:right/:limit/:offset/:orderfeature/desc", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
+	router.POST("/deadletters/:id/replay", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
+		if !requireAdmin(res, jwt) {
+			return
+		}
+		respondDeadLetterCommand(res, ReplayDeadLetter(ps.ByName("id")))
+	})
+
+	router.DELETE("/deadletters/:id", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
+		if !requireAdmin(res, jwt) {
+			return
+		}
+		respondDeadLetterCommand(res, DeleteDeadLetter(ps.ByName("id")))
+	})
+
+	router.POST("/jwt/search/:resource_kind/:query/:right/:limit/:offset/:orderfeature/asc", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
 		kind := ps.ByName("resource_kind")
 		right := ps.ByName("right")
 		query := ps.ByName("query")
@@ -458,17 +510,23 @@ func getRoutes() (router *jwt_http_router.Router) {
 			http.Error(res, err.Error(), http.StatusBadRequest)
 			return
 		}
-		selectionFilter, err := selection.GetFilter(jwt)
+		respondQuery(res, r, kind, jwt, QueryRequest{Rights: right, Text: query, Selection: &selection, Sort: sortBy(order, true)}, limit, offset)
+	})
+
+	router.POST("/jwt/search/:resource_kind/:query/:right/:limit/:offset/:orderfeature/desc", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
+		kind := ps.ByName("resource_kind")
+		right := ps.ByName("right")
+		query := ps.ByName("query")
+		limit := ps.ByName("limit")
+		offset := ps.ByName("offset")
+		order := ps.ByName("orderfeature")
+		selection := Selection{}
+		err := json.NewDecoder(r.Body).Decode(&selection)
 		if err != nil {
 			http.Error(res, err.Error(), http.StatusBadRequest)
 			return
 		}
-		list, err := SearchOrderedListWithSelection(kind, query, jwt.UserId, jwt.RealmAccess.Roles, right, order, false, limit, offset, selectionFilter)
-		if err != nil {
-			http.Error(res, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		response.To(res).Json(list)
+		respondQuery(res, r, kind, jwt, QueryRequest{Rights: right, Text: query, Selection: &selection, Sort: sortBy(order, false)}, limit, offset)
 	})
 
 	router.POST("/jwt/list/:resource_kind/:right/:limit/:offset/:orderfeature/asc", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
@@ -483,17 +541,7 @@ func getRoutes() (router *jwt_http_router.Router) {
 			http.Error(res, err.Error(), http.StatusBadRequest)
 			return
 		}
-		selectionFilter, err := selection.GetFilter(jwt)
-		if err != nil {
-			http.Error(res, err.Error(), http.StatusBadRequest)
-			return
-		}
-		list, err := GetOrderedListForUserOrGroupWithSelection(kind, jwt.UserId, jwt.RealmAccess.Roles, right, limit, offset, orderfeature, true, selectionFilter)
-		if err != nil {
-			http.Error(res, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		response.To(res).Json(list)
+		respondQuery(res, r, kind, jwt, QueryRequest{Rights: right, Selection: &selection, Sort: sortBy(orderfeature, true)}, limit, offset)
 	})
 
 	router.POST("/jwt/list/:resource_kind/:right/:limit/:offset/:orderfeature/desc", func(res http.ResponseWriter, r *http.Request, ps jwt_http_router.Params, jwt jwt_http_router.Jwt) {
@@ -508,18 +556,180 @@ func getRoutes() (router *jwt_http_router.Router) {
 			http.Error(res, err.Error(), http.StatusBadRequest)
 			return
 		}
-		selectionFilter, err := selection.GetFilter(jwt)
-		if err != nil {
-			http.Error(res, err.Error(), http.StatusBadRequest)
-			return
-		}
-		list, err := GetOrderedListForUserOrGroupWithSelection(kind, jwt.UserId, jwt.RealmAccess.Roles, right, limit, offset, orderfeature, false, selectionFilter)
-		if err != nil {
-			http.Error(res, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		response.To(res).Json(list)
+		respondQuery(res, r, kind, jwt, QueryRequest{Rights: right, Selection: &selection, Sort: sortBy(orderfeature, false)}, limit, offset)
 	})
 
 	return
 }
+
+// PageMediaType may be requested in the Accept header to receive a FeaturePage envelope instead of a plain list
+const PageMediaType = "application/vnd.permission-search.page+json"
+
+// respondQuery is the adapter of the path encoded list routes onto the query of POST /v2/query/:resource_kind;
+// a cursor from the X-Next-Cursor header of the previous page may be passed as query parameter "cursor" instead of the offset
+func respondQuery(res http.ResponseWriter, r *http.Request, kind string, jwt jwt_http_router.Jwt, request QueryRequest, limitStr string, offsetStr string) {
+	var err error
+	request.Limit, request.Offset, err = parseLimitOffset(limitStr, offsetStr)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	request.Cursor = r.URL.Query().Get("cursor")
+	if request.Text != "" {
+		request.TextOptions = textOptionsFromUrl(r.URL.Query())
+	}
+	respondQueryPage(res, r, kind, jwt, request, wantsEnvelope(r))
+}
+
+// respondQueryPage responds with the items of the page or with the FeaturePage as envelope; the cursor to the next page is set as X-Next-Cursor header
+func respondQueryPage(res http.ResponseWriter, r *http.Request, kind string, jwt jwt_http_router.Jwt, request QueryRequest, envelope bool) {
+	request, err := resolveQueryRequest(kind, jwt, request)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := Query(kind, jwt.UserId, jwt.RealmAccess.Roles, request)
+	if err == ErrInvalidCursor {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Println("ERROR:", err)
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if page.Next != "" {
+		res.Header().Set("X-Next-Cursor", page.Next)
+	}
+	if envelope {
+		if page.Items == nil {
+			page.Items = []map[string]interface{}{}
+		}
+		response.To(res).Json(page)
+		return
+	}
+	response.To(res).Json(page.Items)
+}
+
+// respondQueryAll responds with all results of the request as json list or, if requested, streams them as newline delimited json
+func respondQueryAll(res http.ResponseWriter, r *http.Request, kind string, jwt jwt_http_router.Jwt, request QueryRequest) {
+	request, err := resolveQueryRequest(kind, jwt, request)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if wantsNdjson(r) {
+		stream := newNdjsonStream(res)
+		err = StreamQuery(r.Context(), kind, jwt.UserId, jwt.RealmAccess.Roles, request, func(item map[string]interface{}) error {
+			return stream.write(item)
+		})
+		stream.finish(r.Context(), err)
+		return
+	}
+	list, err := QueryAll(kind, jwt.UserId, jwt.RealmAccess.Roles, request)
+	if err != nil {
+		log.Println("ERROR:", err)
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response.To(res).Json(list)
+}
+
+// resolveQueryRequest replaces the refs of the selection with the values of the jwt and validates the request
+func resolveQueryRequest(kind string, jwt jwt_http_router.Jwt, request QueryRequest) (QueryRequest, error) {
+	if request.Selection != nil {
+		selection := request.Selection.Resolve(jwt)
+		request.Selection = &selection
+	}
+	return request, request.Validate(kind)
+}
+
+// wantsNdjson checks if the client requested newline delimited json with the query parameter format=ndjson or the Accept header
+func wantsNdjson(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "ndjson" || strings.Contains(r.Header.Get("Accept"), NdjsonMediaType)
+}
+
+// ndjsonStream writes one json document per line and flushes each batch of lines to the client
+type ndjsonStream struct {
+	res     http.ResponseWriter
+	encoder *json.Encoder
+	lines   int
+}
+
+func newNdjsonStream(res http.ResponseWriter) *ndjsonStream {
+	res.Header().Set("Content-Type", NdjsonMediaType)
+	return &ndjsonStream{res: res, encoder: json.NewEncoder(res)}
+}
+
+func (this *ndjsonStream) write(value interface{}) error {
+	if err := this.encoder.Encode(value); err != nil {
+		return err
+	}
+	this.lines++
+	if this.lines%scrollBatchSize() == 0 {
+		this.flush()
+	}
+	return nil
+}
+
+func (this *ndjsonStream) flush() {
+	if flusher, ok := this.res.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// finish flushes the remaining lines; errors after the first line can only be logged, because the status is already sent
+func (this *ndjsonStream) finish(ctx context.Context, err error) {
+	switch {
+	case err != nil && ctx.Err() != nil:
+		log.Println("WARNING: stream cancelled by client after", this.lines, "lines")
+	case err != nil && this.lines == 0:
+		log.Println("ERROR:", err)
+		http.Error(this.res, err.Error(), http.StatusInternalServerError)
+	case err != nil:
+		log.Println("ERROR: stream aborted after", this.lines, "lines:", err)
+	default:
+		this.flush()
+	}
+}
+
+// wantsEnvelope checks if the client opted in to a FeaturePage response with the query parameter envelope=true or the Accept header
+func wantsEnvelope(r *http.Request) bool {
+	return r.URL.Query().Get("envelope") == "true" || strings.Contains(r.Header.Get("Accept"), PageMediaType)
+}
+
+// adminRole is the realm role required by the service administration routes
+const adminRole = "admin"
+
+// requireAdmin responds with 403 and returns false if the token has not the adminRole
+func requireAdmin(res http.ResponseWriter, jwt jwt_http_router.Jwt) bool {
+	for _, role := range jwt.RealmAccess.Roles {
+		if role == adminRole {
+			return true
+		}
+	}
+	http.Error(res, "access denied", http.StatusForbidden)
+	return false
+}
+
+func respondDeadLetterCommand(res http.ResponseWriter, err error) {
+	if err == ErrNotFound {
+		http.Error(res, "unknown dead letter", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("ERROR:", err)
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ok := map[string]string{"status": "ok"}
+	response.To(res).Json(ok)
+}
+
+// queryParam returns the query parameter or fallback if it is not set
+func queryParam(r *http.Request, name string, fallback string) string {
+	if value := r.URL.Query().Get(name); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package lib
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// channelRetryPause is shorter than transportRetryPause to keep tests fast
+const channelRetryPause = 10 * time.Millisecond
+
+// ChannelTransport delivers messages in-process; it is used in tests and single instance setups.
+// Every consumer group has an unbounded queue, so Publish never blocks, also not from within a handler.
+type ChannelTransport struct {
+	mux           sync.Mutex
+	changed       *sync.Cond                                 //signaled when messages are queued or handled and on Close
+	subscriptions map[string]map[string]*channelSubscription //topic -> group -> queue
+	pending       int                                        //published messages not handled yet
+	done          chan struct{}
+	closed        bool
+}
+
+type channelSubscription struct {
+	queue   [][]byte
+	handler TransportHandler
+}
+
+func NewChannelTransport() *ChannelTransport {
+	result := &ChannelTransport{subscriptions: map[string]map[string]*channelSubscription{}, done: make(chan struct{})}
+	result.changed = sync.NewCond(&result.mux)
+	return result
+}
+
+func (this *ChannelTransport) Subscribe(group string, topic string, handler TransportHandler) error {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	if this.closed {
+		return errors.New("transport closed")
+	}
+	if this.subscriptions[topic] == nil {
+		this.subscriptions[topic] = map[string]*channelSubscription{}
+	}
+	if _, ok := this.subscriptions[topic][group]; ok {
+		return errors.New("consumer group " + group + " already subscribed to " + topic)
+	}
+	subscription := &channelSubscription{handler: handler}
+	this.subscriptions[topic][group] = subscription
+	go this.consume(subscription)
+	return nil
+}
+
+func (this *ChannelTransport) consume(subscription *channelSubscription) {
+	for {
+		msg, ok := this.next(subscription)
+		if !ok {
+			return
+		}
+		for err := subscription.handler(msg); err != nil; err = subscription.handler(msg) {
+			log.Println("error while processing msg; message will be delivered again", err)
+			select {
+			case <-this.done:
+				return
+			case <-time.After(channelRetryPause):
+			}
+		}
+		this.mux.Lock()
+		this.pending--
+		this.changed.Broadcast()
+		this.mux.Unlock()
+	}
+}
+
+// next waits for the next message of the subscription; false if the transport is closed
+func (this *ChannelTransport) next(subscription *channelSubscription) (msg []byte, ok bool) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	for len(subscription.queue) == 0 && !this.closed {
+		this.changed.Wait()
+	}
+	if this.closed {
+		return nil, false
+	}
+	msg = subscription.queue[0]
+	subscription.queue = subscription.queue[1:]
+	return msg, true
+}
+
+// Publish delivers the message to every consumer group of the topic; messages of topics without subscriptions are dropped
+func (this *ChannelTransport) Publish(topic string, payload []byte) error {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	if this.closed {
+		return errors.New("transport closed")
+	}
+	for _, subscription := range this.subscriptions[topic] {
+		subscription.queue = append(subscription.queue, payload)
+		this.pending++
+	}
+	this.changed.Broadcast()
+	return nil
+}
+
+// Wait blocks until all published messages are handled or the transport is closed
+func (this *ChannelTransport) Wait() {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	for this.pending > 0 && !this.closed {
+		this.changed.Wait()
+	}
+}
+
+// Close stops the consumers; messages which are not handled yet are dropped and no longer awaited by Wait
+func (this *ChannelTransport) Close() {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	if !this.closed {
+		this.closed = true
+		close(this.done)
+		this.changed.Broadcast()
+	}
+}
@@ -18,55 +18,130 @@ package lib
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	"log"
-
-	"github.com/olivere/elastic"
 )
 
-func SetUserRight(kind string, resource string, user string, rights string) (err error) {
-	ctx := context.Background()
-	entry, version, err := getResourceEntry(ctx, kind, resource)
-	if err != nil {
+type VersionConflictError struct {
+	Kind     string
+	Resource string
+	Attempts int64
+}
+
+func (this VersionConflictError) Error() string {
+	return fmt.Sprintf("version conflict on %v %v after %v attempts", this.Kind, this.Resource, this.Attempts)
+}
+
+func IsVersionConflict(err error) bool {
+	_, ok := err.(VersionConflictError)
+	return ok
+}
+
+// updateEntry reads the entry, applies update and writes it back;
+// on a version conflict this is repeated up to Config.VersionConflictRetry times with exponential backoff
+func updateEntry(ctx context.Context, kind string, resource string, update func(entry *Entry)) error {
+	return updateEntryIf(ctx, kind, resource, func(entry *Entry) bool {
+		update(entry)
+		return true
+	})
+}
+
+// updateEntryIf is updateEntry but the entry is only written if update returns true
+func updateEntryIf(ctx context.Context, kind string, resource string, update func(entry *Entry) bool) error {
+	for attempt := int64(1); ; attempt++ {
+		entry, version, err := getResourceEntry(ctx, kind, resource)
+		if err != nil {
+			return err
+		}
+		if !update(&entry) {
+			return nil
+		}
+		err = GetStorage().Put(ctx, kind, entry, version)
+		if err != ErrVersionConflict {
+			return err
+		}
+		if err = waitForRetry(kind, resource, attempt); err != nil {
+			return err
+		}
+	}
+}
+
+// waitForRetry sleeps before the next attempt after a version conflict or returns a VersionConflictError
+// if Config.VersionConflictRetry is exceeded
+func waitForRetry(kind string, resource string, attempt int64) error {
+	if attempt > Config.VersionConflictRetry {
+		err := VersionConflictError{Kind: kind, Resource: resource, Attempts: attempt}
+		log.Println("ERROR:", err)
 		return err
 	}
-	entry.removeUserRights(user)
-	entry.addUserRights(user, rights)
-	_, err = GetClient().Index().Index(kind).Type(ElasticPermissionType).Id(resource).Version(version).BodyJson(entry).Do(ctx)
+	log.Println("WARNING: version conflict on", kind, resource, "retry", attempt)
+	time.Sleep(conflictBackoff(attempt))
+	return nil
+}
+
+func conflictBackoff(attempt int64) time.Duration {
+	wait := time.Duration(1<<uint(attempt-1)) * 10 * time.Millisecond
+	if wait > time.Second {
+		return time.Second
+	}
+	return wait
+}
+
+func SetUserRight(kind string, resource string, user string, rights string) (err error) {
+	change := RightsChange{User: user}
+	err = updateEntryIf(context.Background(), kind, resource, func(entry *Entry) bool {
+		change.Before = entry.userRights(user)
+		entry.removeUserRights(user)
+		entry.addUserRights(user, rights)
+		change.After = entry.userRights(user)
+		return change.Before != change.After
+	})
+	if err == nil && change.Before != change.After {
+		notifyChange(ChangeEvent{Type: RightsChangedEvent, Kind: kind, Resource: resource, Rights: []RightsChange{change}})
+	}
 	return
 }
 
 func SetGroupRight(kind string, resource string, group string, rights string) (err error) {
-	ctx := context.Background()
-	entry, version, err := getResourceEntry(ctx, kind, resource)
-	if err != nil {
-		return err
+	change := RightsChange{Group: group}
+	err = updateEntryIf(context.Background(), kind, resource, func(entry *Entry) bool {
+		change.Before = entry.groupRights(group)
+		entry.removeGroupRights(group)
+		entry.addGroupRights(group, rights)
+		change.After = entry.groupRights(group)
+		return change.Before != change.After
+	})
+	if err == nil && change.Before != change.After {
+		notifyChange(ChangeEvent{Type: RightsChangedEvent, Kind: kind, Resource: resource, Rights: []RightsChange{change}})
 	}
-	entry.removeGroupRights(group)
-	entry.addGroupRights(group, rights)
-	_, err = GetClient().Index().Index(kind).Type(ElasticPermissionType).Id(resource).Version(version).BodyJson(entry).Do(ctx)
 	return
 }
 
 func DeleteUserRight(kind string, resource string, user string) (err error) {
-	ctx := context.Background()
-	entry, version, err := getResourceEntry(ctx, kind, resource)
-	if err != nil {
-		return err
+	change := RightsChange{User: user}
+	err = updateEntryIf(context.Background(), kind, resource, func(entry *Entry) bool {
+		change.Before = entry.userRights(user)
+		entry.removeUserRights(user)
+		return change.Before != ""
+	})
+	if err == nil && change.Before != "" {
+		notifyChange(ChangeEvent{Type: RightsChangedEvent, Kind: kind, Resource: resource, Rights: []RightsChange{change}})
 	}
-	entry.removeUserRights(user)
-	_, err = GetClient().Index().Index(kind).Type(ElasticPermissionType).Id(resource).Version(version).BodyJson(entry).Do(ctx)
 	return
 }
 
 func DeleteGroupRight(kind string, resource string, group string) (err error) {
-	ctx := context.Background()
-	entry, version, err := getResourceEntry(ctx, kind, resource)
-	if err != nil {
-		return err
+	change := RightsChange{Group: group}
+	err = updateEntryIf(context.Background(), kind, resource, func(entry *Entry) bool {
+		change.Before = entry.groupRights(group)
+		entry.removeGroupRights(group)
+		return change.Before != ""
+	})
+	if err == nil && change.Before != "" {
+		notifyChange(ChangeEvent{Type: RightsChangedEvent, Kind: kind, Resource: resource, Rights: []RightsChange{change}})
 	}
-	entry.removeGroupRights(group)
-	_, err = GetClient().Index().Index(kind).Type(ElasticPermissionType).Id(resource).Version(version).BodyJson(entry).Do(ctx)
 	return
 }
 
@@ -75,41 +150,84 @@ func UpdateFeatures(kind string, msg []byte, command CommandWrapper) (err error)
 	if err != nil {
 		return err
 	}
+	eventVersion, versioned, err := eventVersion(kind, msg)
+	if err != nil {
+		return UnprocessableEventError{Err: err}
+	}
 	ctx := context.Background()
 	exists, err := resourceExists(ctx, kind, command.Id)
 	if err != nil {
 		return err
 	}
-	if exists {
-		entry, version, err := getResourceEntry(ctx, kind, command.Id)
-		if err != nil {
+	if !exists {
+		entry := Entry{Resource: command.Id, Features: features, Creator: command.Owner, EventVersion: eventVersion}
+		entry.setDefaultPermissions(kind, command.Owner)
+		err = GetStorage().Create(ctx, kind, entry)
+		if err == nil {
+			notifyChange(ChangeEvent{Type: FeaturesChangedEvent, Kind: kind, Resource: command.Id, Rights: entry.rightsChanges(false)})
+		}
+		if err != ErrVersionConflict {
 			return err
 		}
+		//created by a concurrent event; update it unless this event is older
+	}
+	applied := false
+	err = updateEntryIf(ctx, kind, command.Id, func(entry *Entry) bool {
+		applied = !isStale(*entry, eventVersion, versioned)
+		if !applied {
+			discardStaleEvent(kind, command.Id, command.Command, eventVersion, entry.EventVersion)
+			return false
+		}
 		entry.Features = features
+		if versioned {
+			entry.EventVersion = eventVersion
+		}
 		if entry.Creator == "" && len(entry.AdminUsers) > 0 {
 			entry.Creator = entry.AdminUsers[0]
 		}
-		_, err = GetClient().Index().Index(kind).Type(ElasticPermissionType).Id(command.Id).Version(version).BodyJson(entry).Do(ctx)
-	} else {
-		entry := Entry{Resource: command.Id, Features: features, Creator: command.Owner}
-		entry.setDefaultPermissions(kind, command.Owner)
-		_, err = GetClient().Index().Index(kind).Type(ElasticPermissionType).Id(command.Id).BodyJson(entry).Do(ctx)
+		return true
+	})
+	if err == nil && applied {
+		notifyChange(ChangeEvent{Type: FeaturesChangedEvent, Kind: kind, Resource: command.Id})
 	}
 	return
-
 }
 
 func DeleteFeatures(kind string, command CommandWrapper) (err error) {
+	return deleteFeatures(kind, command, 0, false)
+}
+
+// deleteFeatures deletes the resource unless the event carries a version older than the stored one;
+// the delete is conditional on the read version, so an entry written meanwhile is checked again
+func deleteFeatures(kind string, command CommandWrapper, eventVersion int64, versioned bool) (err error) {
 	ctx := context.Background()
-	exists, err := GetClient().Exists().Index(kind).Type(ElasticPermissionType).Id(command.Id).Do(ctx)
-	if err != nil {
-		log.Println("ERROR: DeleteFeatures() check existence ", err)
-		return err
-	}
-	if exists {
-		_, err = GetClient().Delete().Index(kind).Type(ElasticPermissionType).Id(command.Id).Do(ctx)
+	for attempt := int64(1); ; attempt++ {
+		entry, version, err := getResourceEntry(ctx, kind, command.Id)
+		if err == ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			log.Println("ERROR: DeleteFeatures() read entry ", err)
+			return err
+		}
+		if isStale(entry, eventVersion, versioned) {
+			discardStaleEvent(kind, command.Id, command.Command, eventVersion, entry.EventVersion)
+			return nil
+		}
+		err = GetStorage().Delete(ctx, kind, command.Id, version)
+		if err == ErrNotFound {
+			return nil
+		}
+		if err != ErrVersionConflict {
+			if err == nil {
+				notifyChange(ChangeEvent{Type: ResourceDeletedEvent, Kind: kind, Resource: command.Id, Rights: entry.rightsChanges(true)})
+			}
+			return err
+		}
+		if err = waitForRetry(kind, command.Id, attempt); err != nil {
+			return err
+		}
 	}
-	return
 }
 
 func DeleteUser(user string) (err error) {
@@ -124,21 +242,18 @@ func DeleteUser(user string) (err error) {
 
 func DeleteUserFromResourceKind(kind string, user string) (err error) {
 	ctx := context.Background()
-	query := elastic.NewBoolQuery().Should(
-		elastic.NewTermQuery("admin_users", user),
-		elastic.NewTermQuery("read_users", user),
-		elastic.NewTermQuery("write_users", user),
-		elastic.NewTermQuery("execute_users", user))
-	result, err := GetClient().Search().Index(kind).Type(ElasticPermissionType).Version(true).Query(query).Do(ctx)
+	selection := Selection{Or: []Selection{
+		{Condition: ConditionConfig{Feature: "admin_users", Operation: QueryEqualOperation, Value: user}},
+		{Condition: ConditionConfig{Feature: "read_users", Operation: QueryEqualOperation, Value: user}},
+		{Condition: ConditionConfig{Feature: "write_users", Operation: QueryEqualOperation, Value: user}},
+		{Condition: ConditionConfig{Feature: "execute_users", Operation: QueryEqualOperation, Value: user}},
+	}}
+	result, err := GetStorage().Search(ctx, kind, SearchQuery{Selection: &selection})
 	if err != nil {
 		return err
 	}
-	for _, hit := range result.Hits.Hits {
-		if hit.Type != ElasticPermissionType {
-			log.Println("DEBUG: DeleteUserFromResourceKind: unknown type", hit.Type)
-			continue
-		}
-		err = DeleteUserRight(kind, hit.Id, user)
+	for _, entry := range result.Hits {
+		err = DeleteUserRight(kind, entry.Resource, user)
 		if err != nil {
 			return err
 		}
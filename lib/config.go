@@ -18,6 +18,7 @@ package lib
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -36,23 +37,45 @@ type ResourceConfig struct {
 	Features              []Feature
 	InitialGroupRights    map[string]string
 	SearchFallbackFeature string
+	DefaultProjection     *Projection //features returned by list and search requests without fields; nil returns all features
+	VersionPath           string      //JSONPath of a monotonic version or timestamp in resource events; older events are discarded
 }
 
 type ConfigStruct struct {
 	ServerPort string
 	LogLevel   string
 
+	Transport string //"amqp" (default), "kafka" or "channel" (in-process)
+
 	AmqpUrl              string
 	AmqpReconnectTimeout int64
-	AmqpConsumerName     string
+	AmqpConsumerName     string //prefix of the queues (amqp) or consumer groups (kafka): <AmqpConsumerName>_<topic>
+
+	KafkaBrokers []string
+
+	EventRetry      int64            //attempts to handle an event before it is moved to the DeadLetterTopic; 0 retries forever
+	TopicEventRetry map[string]int64 //EventRetry per topic
+	DeadLetterTopic string           //empty drops failed events with a WARNING
+
+	NotificationTopic string //topic of the ChangeEvents published after rights or features changed; empty disables them
 
 	PermTopic string
 	UserTopic string
 
+	Storage string
+
+	VersionConflictRetry int64
+
+	ScrollBatchSize int64 //entries per batch of scrolls over all entries (full lists, exports and migrations); default 100
+
 	ElasticUrl     string
 	ElasticRetry   int64
 	ElasticMapping map[string]map[string]interface{}
 
+	ElasticMappingMigration string
+	ElasticReindexTimeout   int64 //seconds each reindex of a Mapping-Migration may take before it is cancelled; default 3600
+	ElasticTypeless         string
+
 	JwtPubRsa string
 	ForceUser string
 	ForceAuth string
@@ -60,7 +83,7 @@ type ConfigStruct struct {
 	Resources    map[string]ResourceConfig
 	ResourceList []string `json:"-"`
 
-	InitialGroupRightsUpdate string
+	InitialGroupRightsUpdate string //"true" applies InitialGroupRights to all entries, "reconcile" also removes rights dropped since the last update
 
 	ConsumptionPause string
 
@@ -87,6 +110,29 @@ func LoadConfig(location string) error {
 	HandleEnvironmentVars(&configuration)
 	Config = &configuration
 	Config.ResourceList = getResourceList(Config)
+	error = validateConfig(Config)
+	if error != nil {
+		log.Println("invalid config: ", error)
+		return error
+	}
+	return nil
+}
+
+func validateConfig(config ConfigType) error {
+	for kind, resource := range config.Resources {
+		if resource.SearchFallbackFeature == "" {
+			continue
+		}
+		known := false
+		for _, feature := range resource.Features {
+			if feature.Name == resource.SearchFallbackFeature {
+				known = true
+			}
+		}
+		if !known {
+			return errors.New("SearchFallbackFeature " + resource.SearchFallbackFeature + " of " + kind + " is not in its Features")
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// FeaturePage is one page of a feature list; Next is the cursor to the following page and empty on the last page
+type FeaturePage struct {
+	Items  []map[string]interface{} `json:"items"`
+	Total  int64                    `json:"total"`
+	Limit  int                      `json:"limit"`
+	Offset int                      `json:"offset"`
+	Next   string                   `json:"next"`
+}
+
+// ListPage searches one page of features; a cursor returned as FeaturePage.Next by the same query continues after
+// the last hit of the previous page (search_after) and replaces the offset
+func ListPage(kind string, query SearchQuery, cursor string) (page FeaturePage, err error) {
+	if cursor != "" {
+		query.After, err = decodeCursor(cursor, len(query.sortFields(kind)))
+		if err != nil {
+			return page, err
+		}
+		query.Offset = 0
+	}
+	resp, query, err := searchWithFallback(context.Background(), kind, query)
+	if err != nil {
+		return page, err
+	}
+	page.Items = toFeatureList(resp.Hits, query.User, query.Groups)
+	page.Total = resp.Total
+	page.Offset = query.Offset
+	page.Limit = query.Limit
+	if page.Limit <= 0 {
+		page.Limit = defaultSearchSize
+	}
+	if len(resp.Hits) >= page.Limit && resp.Next != nil {
+		page.Next, err = encodeCursor(resp.Next)
+	}
+	return
+}
+
+// listAll returns the features of all entries matching the query from one scroll snapshot in the order of the query
+func listAll(kind string, query SearchQuery) (result []map[string]interface{}, err error) {
+	err = scrollFeatures(context.Background(), kind, query, func(items []map[string]interface{}) error {
+		result = append(result, items...)
+		return nil
+	})
+	return
+}
+
+func encodeCursor(after []interface{}) (string, error) {
+	temp, err := json.Marshal(after)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(temp), nil
+}
+
+func decodeCursor(cursor string, length int) (after []interface{}, err error) {
+	temp, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return after, ErrInvalidCursor
+	}
+	//numbers are kept as json.Number, long sort values above 2^53 would lose precision as float64
+	decoder := json.NewDecoder(bytes.NewReader(temp))
+	decoder.UseNumber()
+	err = decoder.Decode(&after)
+	if err != nil || decoder.More() || len(after) != length {
+		return after, ErrInvalidCursor
+	}
+	return after, nil
+}
@@ -0,0 +1,232 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// UnprocessableEventError marks events which can never be handled, like malformed json or unknown commands;
+// they are moved to the dead letters without retry
+type UnprocessableEventError struct {
+	Err error
+}
+
+func (this UnprocessableEventError) Error() string {
+	return this.Err.Error()
+}
+
+func IsUnprocessableEvent(err error) bool {
+	_, ok := err.(UnprocessableEventError)
+	return ok
+}
+
+// DeadLetter is published to Config.DeadLetterTopic for an event which failed Config.EventRetry times or is unprocessable
+type DeadLetter struct {
+	Id       string    `json:"id"`
+	Topic    string    `json:"topic"`
+	Payload  string    `json:"payload"` //original message; a string to keep malformed json
+	Error    string    `json:"error"`
+	Attempts int64     `json:"attempts"`
+	Time     time.Time `json:"time"`
+}
+
+// DeadLetterIndex is the index (elasticsearch) storing the dead letters consumed from Config.DeadLetterTopic
+const DeadLetterIndex = "dead_letters"
+
+// defaultDeadLetterPageSize is the number of dead letters listed if no limit is given
+const defaultDeadLetterPageSize = 100
+
+// eventRetryLimit returns the number of attempts to handle an event of the topic; 0 retries forever
+func eventRetryLimit(topic string) int64 {
+	if limit, ok := Config.TopicEventRetry[topic]; ok {
+		return limit
+	}
+	return Config.EventRetry
+}
+
+// the attempts of a message are forgotten if it has not failed for attemptTTL, for example because
+// another instance handled it, or if more than maxTrackedMessages messages are failing at once
+const (
+	attemptTTL         = time.Hour
+	maxTrackedMessages = 10000
+)
+
+type attempt struct {
+	count int64
+	seen  time.Time
+}
+
+// attemptCounter counts the failed attempts per message
+type attemptCounter struct {
+	mux       sync.Mutex
+	attempts  map[[sha256.Size]byte]attempt
+	lastSweep time.Time
+}
+
+func newAttemptCounter() *attemptCounter {
+	return &attemptCounter{attempts: map[[sha256.Size]byte]attempt{}, lastSweep: time.Now()}
+}
+
+func (this *attemptCounter) increment(key [sha256.Size]byte, now time.Time) int64 {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	if now.Sub(this.lastSweep) > attemptTTL || len(this.attempts) >= maxTrackedMessages {
+		this.evict(now)
+	}
+	element := this.attempts[key]
+	element.count++
+	element.seen = now
+	this.attempts[key] = element
+	return element.count
+}
+
+func (this *attemptCounter) reset(key [sha256.Size]byte) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	delete(this.attempts, key)
+}
+
+// evict removes expired attempts and, if still too many are tracked, the least recently failed ones
+func (this *attemptCounter) evict(now time.Time) {
+	this.lastSweep = now
+	for key, element := range this.attempts {
+		if now.Sub(element.seen) > attemptTTL {
+			delete(this.attempts, key)
+		}
+	}
+	if len(this.attempts) < maxTrackedMessages {
+		return
+	}
+	keys := make([][sha256.Size]byte, 0, len(this.attempts))
+	for key := range this.attempts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return this.attempts[keys[i]].seen.Before(this.attempts[keys[j]].seen)
+	})
+	for _, key := range keys[:len(keys)-maxTrackedMessages/2] {
+		delete(this.attempts, key)
+	}
+}
+
+// deadLetterHandler counts the failed attempts of each message and moves it to the dead letters
+// if the retry limit of the topic is reached or the message is unprocessable.
+// Attempts are counted per instance of the service.
+func deadLetterHandler(topic string, handler TransportHandler) TransportHandler {
+	attempts := newAttemptCounter()
+	return func(msg []byte) error {
+		err := handler(msg)
+		key := sha256.Sum256(msg)
+		if err == nil {
+			attempts.reset(key)
+			return nil
+		}
+		count := attempts.increment(key, time.Now())
+		limit := eventRetryLimit(topic)
+		if !IsUnprocessableEvent(err) && (limit <= 0 || count < limit) {
+			log.Println("WARNING: event of", topic, "failed in attempt", count, err)
+			return err
+		}
+		if publishErr := moveToDeadLetters(topic, msg, err, count); publishErr != nil {
+			log.Println("ERROR: unable to move event of", topic, "to dead letters", publishErr)
+			return err
+		}
+		attempts.reset(key)
+		return nil
+	}
+}
+
+func moveToDeadLetters(topic string, msg []byte, cause error, attempts int64) error {
+	if Config.DeadLetterTopic == "" {
+		log.Println("WARNING: drop event of", topic, "after", attempts, "attempts:", cause, string(msg))
+		return nil
+	}
+	id, err := newDeadLetterId()
+	if err != nil {
+		return err
+	}
+	log.Println("WARNING: move event of", topic, "to dead letters after", attempts, "attempts:", cause)
+	return sendEvent(Config.DeadLetterTopic, DeadLetter{
+		Id:       id,
+		Topic:    topic,
+		Payload:  string(msg),
+		Error:    cause.Error(),
+		Attempts: attempts,
+		Time:     time.Now().UTC(),
+	})
+}
+
+func newDeadLetterId() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// handleDeadLetter stores the dead letters of Config.DeadLetterTopic, which is consumed by one instance of the service
+func handleDeadLetter(msg []byte) error {
+	letter := DeadLetter{}
+	if err := json.Unmarshal(msg, &letter); err != nil || letter.Id == "" {
+		log.Println("WARNING: unable to read dead letter", err, string(msg))
+		return nil
+	}
+	return GetStorage().PutDeadLetter(context.Background(), letter)
+}
+
+// ListDeadLetters returns the stored dead letters, oldest first
+func ListDeadLetters(limit int, offset int) ([]DeadLetter, error) {
+	if limit < 0 || offset < 0 {
+		return nil, errors.New("limit and offset must not be negative")
+	}
+	if limit == 0 {
+		limit = defaultDeadLetterPageSize
+	}
+	return GetStorage().ListDeadLetters(context.Background(), limit, offset)
+}
+
+// ReplayDeadLetter publishes the payload of the dead letter to its original topic and deletes the dead letter
+func ReplayDeadLetter(id string) error {
+	ctx := context.Background()
+	letter, err := GetStorage().GetDeadLetter(ctx, id)
+	if err != nil {
+		return err
+	}
+	transport, err := GetTransport()
+	if err != nil {
+		return err
+	}
+	if err = transport.Publish(letter.Topic, []byte(letter.Payload)); err != nil {
+		return err
+	}
+	log.Println("replay dead letter", letter.Id, "of", letter.Topic)
+	return GetStorage().DeleteDeadLetter(ctx, id)
+}
+
+// DeleteDeadLetter discards the dead letter
+func DeleteDeadLetter(id string) error {
+	return GetStorage().DeleteDeadLetter(context.Background(), id)
+}
@@ -30,12 +30,20 @@ import (
 
 	"encoding/json"
 
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
 	"github.com/olivere/elastic"
 )
 
 var client *elastic.Client
 var once sync.Once
 
+// elasticTypeless is set for elasticsearch >= 7, where documents are stored without mapping type
+var elasticTypeless bool
+
 func GetClient() *elastic.Client {
 	once.Do(func() {
 		client = createClient()
@@ -45,7 +53,13 @@ func GetClient() *elastic.Client {
 
 func createClient() (result *elastic.Client) {
 	ctx := context.Background()
-	result, err := elastic.NewClient(elastic.SetURL(Config.ElasticUrl), elastic.SetRetrier(newRetrier()))
+	httpClient := &http.Client{Transport: typelessTransport{base: http.DefaultTransport}}
+	//the NumberDecoder keeps long sort values of hits, which are passed on as search_after cursors, as json.Number
+	result, err := elastic.NewClient(elastic.SetURL(Config.ElasticUrl), elastic.SetRetrier(newRetrier()), elastic.SetHttpClient(httpClient), elastic.SetDecoder(&elastic.NumberDecoder{}))
+	if err != nil {
+		panic(err)
+	}
+	elasticTypeless, err = useTypeless(result)
 	if err != nil {
 		panic(err)
 	}
@@ -55,9 +69,31 @@ func createClient() (result *elastic.Client) {
 			panic(err)
 		}
 	}
+	err = createServiceIndex(ctx, result, DeadLetterIndex, DeadLetterMapping)
+	if err != nil {
+		panic(err)
+	}
+	err = createServiceIndex(ctx, result, StateIndex, StateMapping)
+	if err != nil {
+		panic(err)
+	}
 	return
 }
 
+// createServiceIndex creates an index for data of the service itself, like dead letters, if it does not exist
+func createServiceIndex(ctx context.Context, client *elastic.Client, index string, properties string) error {
+	exists, err := client.IndexExists(index).Do(ctx)
+	if err != nil || exists {
+		return err
+	}
+	mapping := map[string]interface{}{}
+	err = json.Unmarshal([]byte(properties), &mapping)
+	if err != nil {
+		return err
+	}
+	return createIndexVersion(ctx, client, index, map[string]interface{}{"mappings": typedMappings(mapping)})
+}
+
 func createIndex(kind string, client *elastic.Client, ctx context.Context) (err error) {
 	exists, err := client.IndexExists(kind).Do(ctx)
 	if err != nil {
@@ -70,16 +106,84 @@ func createIndex(kind string, client *elastic.Client, ctx context.Context) (err
 	mappingJson, _ := json.Marshal(mapping)
 	log.Println("expected index setting ", kind, string(mappingJson))
 	if !exists {
-		createIndex, err := client.CreateIndex(kind + "_v1").BodyJson(mapping).Do(ctx)
+		err = createIndexVersion(ctx, client, kind+"_v1", mapping)
 		if err != nil {
 			return err
 		}
-		if !createIndex.Acknowledged {
-			return errors.New("index not acknowledged")
-		}
 		_, err = client.Alias().Add(kind+"_v1", kind).Do(ctx)
+		return err
 	}
-	return
+	if Config.ElasticMappingMigration == "true" {
+		_, err = migrateMapping(ctx, client, kind)
+		if err != nil {
+			log.Println("ERROR: mapping migration of", kind, "failed; continue with current index:", err)
+		}
+		return nil
+	}
+	_, changed, err := mappingChanged(ctx, client, kind)
+	if err != nil {
+		log.Println("WARNING: unable to compare mapping of", kind, err)
+		return nil
+	}
+	if changed {
+		log.Println("WARNING: set ElasticMappingMigration to \"true\" or run with -migrate to update", kind)
+	}
+	return nil
+}
+
+func createIndexVersion(ctx context.Context, client *elastic.Client, index string, mapping interface{}) error {
+	createIndex, err := client.CreateIndex(index).BodyJson(mapping).Do(ctx)
+	if err != nil {
+		return err
+	}
+	if !createIndex.Acknowledged {
+		return errors.New("index not acknowledged")
+	}
+	return nil
+}
+
+func useTypeless(client *elastic.Client) (bool, error) {
+	switch Config.ElasticTypeless {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	version, err := client.ElasticsearchVersion(Config.ElasticUrl)
+	if err != nil {
+		return false, err
+	}
+	major, err := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	if err != nil {
+		return false, err
+	}
+	log.Println("elasticsearch version", version, "typeless:", major >= 7)
+	return major >= 7, nil
+}
+
+func documentType() string {
+	if elasticTypeless {
+		return "_doc"
+	}
+	return ElasticPermissionType
+}
+
+// typelessTransport requests hits.total as number from elasticsearch >= 7, as expected by the client
+type typelessTransport struct {
+	base http.RoundTripper
+}
+
+func (this typelessTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if elasticTypeless && strings.Contains(req.URL.Path, "_search") {
+		clone := *req
+		reqUrl := *req.URL
+		query := reqUrl.Query()
+		query.Set("rest_total_hits_as_int", "true")
+		reqUrl.RawQuery = query.Encode()
+		clone.URL = &reqUrl
+		req = &clone
+	}
+	return this.base.RoundTrip(req)
 }
 
 type MyRetrier struct {
@@ -106,3 +210,561 @@ func (r *MyRetrier) Retry(ctx context.Context, retry int, req *http.Request, res
 	wait, stop := r.backoff.Next(retry)
 	return wait, stop, nil
 }
+
+type ElasticStorage struct {
+	client *elastic.Client
+}
+
+func NewElasticStorage(client *elastic.Client) *ElasticStorage {
+	return &ElasticStorage{client: client}
+}
+
+func (this *ElasticStorage) Exists(ctx context.Context, kind string, resource string) (exists bool, err error) {
+	return this.client.Exists().Index(kind).Type(documentType()).Id(resource).Do(ctx)
+}
+
+func (this *ElasticStorage) Get(ctx context.Context, kind string, resource string) (entry Entry, version Version, err error) {
+	resp, err := this.client.Get().Index(kind).Type(documentType()).Id(resource).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return entry, version, ErrNotFound
+	}
+	if err != nil {
+		return entry, version, err
+	}
+	version = elasticVersion(resp.Version, resp.SeqNo, resp.PrimaryTerm)
+	err = json.Unmarshal(*resp.Source, &entry)
+	return
+}
+
+func (this *ElasticStorage) Put(ctx context.Context, kind string, entry Entry, version Version) (err error) {
+	index := this.client.Index().Index(kind).Type(documentType()).Id(entry.Resource).BodyJson(entry)
+	switch {
+	case version.PrimaryTerm > 0:
+		index = index.IfSeqNo(version.Number).IfPrimaryTerm(version.PrimaryTerm)
+	case version.IsSet():
+		index = index.Version(version.Number)
+	}
+	_, err = index.Do(ctx)
+	if elastic.IsConflict(err) {
+		return ErrVersionConflict
+	}
+	return
+}
+
+// Create indexes with op_type create, which is rejected with 409 if the id exists
+func (this *ElasticStorage) Create(ctx context.Context, kind string, entry Entry) (err error) {
+	_, err = this.client.Index().Index(kind).Type(documentType()).Id(entry.Resource).OpType("create").BodyJson(entry).Do(ctx)
+	if elastic.IsConflict(err) {
+		return ErrVersionConflict
+	}
+	return
+}
+
+func (this *ElasticStorage) Delete(ctx context.Context, kind string, resource string, version Version) (err error) {
+	remove := this.client.Delete().Index(kind).Type(documentType()).Id(resource)
+	switch {
+	case version.PrimaryTerm > 0:
+		remove = remove.IfSeqNo(version.Number).IfPrimaryTerm(version.PrimaryTerm)
+	case version.IsSet():
+		remove = remove.Version(version.Number)
+	}
+	_, err = remove.Do(ctx)
+	if elastic.IsNotFound(err) {
+		return ErrNotFound
+	}
+	if elastic.IsConflict(err) {
+		return ErrVersionConflict
+	}
+	return
+}
+
+func (this *ElasticStorage) Search(ctx context.Context, kind string, query SearchQuery) (result SearchResult, err error) {
+	elasticQuery, err := buildElasticQuery(query)
+	if err != nil {
+		return result, err
+	}
+	search := this.search(kind).Version(true).Query(elasticQuery)
+	if query.Limit > 0 {
+		search = search.Size(query.Limit)
+	}
+	if query.Offset > 0 {
+		search = search.From(query.Offset)
+	}
+	search = search.SortBy(elasticSorters(kind, query)...)
+	if query.Projection != nil {
+		search = search.FetchSourceContext(elasticSourceContext(*query.Projection))
+	}
+	if query.After != nil {
+		search = search.SearchAfter(query.After...)
+	}
+	if highlight := elasticHighlight(textPaths(kind, query), query); highlight != nil {
+		search = search.Highlight(highlight)
+	}
+	resp, err := search.Do(ctx)
+	if err != nil {
+		return result, err
+	}
+	result.Total = resp.Hits.TotalHits
+	result.Hits, err = this.hitsToEntries(resp.Hits.Hits)
+	if count := len(resp.Hits.Hits); count > 0 {
+		result.Next = resp.Hits.Hits[count-1].Sort
+	}
+	return
+}
+
+func elasticSorters(kind string, query SearchQuery) (result []elastic.Sorter) {
+	for _, key := range query.sortFields(kind) {
+		switch {
+		case key.field == scoreSortKey:
+			result = append(result, elastic.NewScoreSort().Order(key.asc))
+		case key.lowercase:
+			result = append(result, elastic.NewFieldSort(key.field+"."+lowercaseSortField).Order(key.asc))
+		default:
+			result = append(result, elastic.NewFieldSort(key.field).Order(key.asc))
+		}
+	}
+	return
+}
+
+// elasticHighlight requests the matching values of the features as highlight of each hit; nil if the query requests no highlighting.
+// The highlighter reads the complete _source, so features left out by the projection are highlighted too.
+func elasticHighlight(paths []string, query SearchQuery) *elastic.Highlight {
+	if !query.TextOptions.Highlight || query.Text == "" || len(paths) == 0 {
+		return nil
+	}
+	result := elastic.NewHighlight().PreTags("<em>").PostTags("</em>").NumOfFragments(0)
+	for _, path := range paths {
+		result = result.Fields(elastic.NewHighlighterField(path).HighlightQuery(elasticHighlightQuery(path, query)))
+	}
+	return result
+}
+
+// elasticHighlightQuery matches the text against a single feature; like the edge_ngrams of feature_search
+// every word of the text also matches the words of the feature starting with it
+func elasticHighlightQuery(path string, query SearchQuery) elastic.Query {
+	should := []elastic.Query{query.TextOptions.elasticQuery(strings.TrimPrefix(path, "features."), query.Text)}
+	for _, token := range tokenize(query.Text) {
+		should = append(should, elastic.NewPrefixQuery(path, token))
+	}
+	return elastic.NewBoolQuery().Should(should...)
+}
+
+// elasticSourceContext translates the projection of features to _source includes/excludes of the whole document
+func elasticSourceContext(projection Projection) *elastic.FetchSourceContext {
+	result := elastic.NewFetchSourceContext(true)
+	if len(projection.Includes) > 0 {
+		result = result.Include("resource", "creator", "admin_users", "admin_groups", "read_users", "read_groups", "write_users", "write_groups", "execute_users", "execute_groups")
+		for _, feature := range projection.Includes {
+			result = result.Include("features." + feature)
+		}
+	}
+	for _, feature := range projection.Excludes {
+		result = result.Exclude("features." + feature)
+	}
+	return result
+}
+
+func (this *ElasticStorage) Export(ctx context.Context, kind string, limit int, offset int) (result []Entry, err error) {
+	resp, err := this.search(kind).Query(elastic.NewMatchAllQuery()).Size(limit).From(offset).Do(ctx)
+	if err != nil {
+		return result, err
+	}
+	return this.hitsToEntries(resp.Hits.Hits)
+}
+
+func (this *ElasticStorage) Scroll(ctx context.Context, kind string, query SearchQuery, batchSize int, handler func([]VersionedEntry) error) error {
+	elasticQuery, err := buildElasticQuery(query)
+	if err != nil {
+		return err
+	}
+	source := elastic.NewSearchSource().Query(elasticQuery).Version(true).SortBy(elasticSorters(kind, query)...)
+	if elasticTypeless {
+		source = source.SeqNoAndPrimaryTerm(true)
+	}
+	if query.Projection != nil {
+		source = source.FetchSourceContext(elasticSourceContext(*query.Projection))
+	}
+	if highlight := elasticHighlight(textPaths(kind, query), query); highlight != nil {
+		source = source.Highlight(highlight)
+	}
+	scroll := this.client.Scroll(kind).SearchSource(source).Size(batchSize)
+	if !elasticTypeless {
+		scroll = scroll.Type(ElasticPermissionType)
+	}
+	defer scroll.Clear(context.Background())
+	for {
+		resp, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		batch, err := this.hitsToVersionedEntries(resp.Hits.Hits)
+		if err != nil {
+			return err
+		}
+		if err = handler(batch); err != nil {
+			return err
+		}
+	}
+}
+
+func (this *ElasticStorage) PutBulk(ctx context.Context, kind string, entries []VersionedEntry) (conflicts []string, err error) {
+	if len(entries) == 0 {
+		return
+	}
+	bulk := this.client.Bulk().Index(kind)
+	for _, element := range entries {
+		request := elastic.NewBulkIndexRequest().Id(element.Entry.Resource).Doc(element.Entry)
+		if !elasticTypeless {
+			request = request.Type(ElasticPermissionType)
+		}
+		switch {
+		case element.Version.PrimaryTerm > 0:
+			request = request.IfSeqNo(element.Version.Number).IfPrimaryTerm(element.Version.PrimaryTerm)
+		case element.Version.IsSet():
+			request = request.Version(element.Version.Number)
+		}
+		bulk = bulk.Add(request)
+	}
+	resp, err := bulk.Do(ctx)
+	if err != nil {
+		return conflicts, err
+	}
+	for _, item := range resp.Failed() {
+		if item.Status == http.StatusConflict {
+			conflicts = append(conflicts, item.Id)
+			continue
+		}
+		reason := ""
+		if item.Error != nil {
+			reason = item.Error.Reason
+		}
+		err = fmt.Errorf("bulk index of %v %v failed: %v", kind, item.Id, reason)
+	}
+	return conflicts, err
+}
+
+func (this *ElasticStorage) SearchKinds(ctx context.Context, kinds []string, query SearchQuery) (result KindSearchResult, err error) {
+	elasticQuery, err := buildElasticQuery(query)
+	if err != nil {
+		return result, err
+	}
+	search := this.client.Search().Index(kinds...)
+	if !elasticTypeless {
+		search = search.Type(ElasticPermissionType)
+	}
+	search = search.Query(elasticQuery).TrackScores(true).SortBy(elastic.NewScoreSort(), elastic.NewFieldSort("resource").Asc())
+	if query.Limit > 0 {
+		search = search.Size(query.Limit)
+	}
+	if query.Offset > 0 {
+		search = search.From(query.Offset)
+	}
+	if query.Projection != nil {
+		search = search.FetchSourceContext(elasticSourceContext(*query.Projection))
+	}
+	paths := []string{}
+	seen := map[string]bool{}
+	for _, kind := range kinds {
+		for _, path := range textPaths(kind, query) {
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	if highlight := elasticHighlight(paths, query); highlight != nil {
+		search = search.Highlight(highlight)
+	}
+	resp, err := search.Do(ctx)
+	if err != nil {
+		return result, err
+	}
+	result.Total = resp.Hits.TotalHits
+	result.Hits = []KindEntry{}
+	for _, hit := range resp.Hits.Hits {
+		entries, err := this.hitsToEntries([]*elastic.SearchHit{hit})
+		if err != nil {
+			return result, err
+		}
+		for _, entry := range entries {
+			element := KindEntry{Kind: kindOfIndex(hit.Index, kinds), Entry: entry}
+			if hit.Score != nil {
+				element.Score = *hit.Score
+			}
+			result.Hits = append(result.Hits, element)
+		}
+	}
+	return
+}
+
+// kindOfIndex returns the kind of an index name returned in a hit; the kinds are aliases of indices named <kind>_v<version>
+func kindOfIndex(index string, kinds []string) string {
+	for _, kind := range kinds {
+		if index == kind {
+			return kind
+		}
+		if _, err := indexVersion(kind, index); err == nil {
+			return kind
+		}
+	}
+	return index
+}
+
+func (this *ElasticStorage) Facets(ctx context.Context, kind string, query SearchQuery, facets []Facet) (result map[string][]FacetBucket, err error) {
+	elasticQuery, err := buildElasticQuery(query)
+	if err != nil {
+		return result, err
+	}
+	search := this.search(kind).Query(elasticQuery).Size(0)
+	for i, facet := range facets {
+		field := "features." + facet.Feature
+		if facet.Interval != "" {
+			search = search.Aggregation(facetName(i), dateHistogramAggregation{field: field, interval: facet.Interval})
+		} else {
+			search = search.Aggregation(facetName(i), elastic.NewTermsAggregation().Field(field).Size(facet.Size))
+		}
+	}
+	resp, err := search.Do(ctx)
+	if err != nil {
+		return result, err
+	}
+	result = map[string][]FacetBucket{}
+	for i, facet := range facets {
+		buckets := []FacetBucket{}
+		if facet.Interval != "" {
+			if aggregation, ok := resp.Aggregations.DateHistogram(facetName(i)); ok {
+				for _, bucket := range aggregation.Buckets {
+					element := FacetBucket{Key: bucket.Key, Count: bucket.DocCount}
+					if bucket.KeyAsString != nil {
+						element.KeyAsString = *bucket.KeyAsString
+					}
+					buckets = append(buckets, element)
+				}
+			}
+		} else if aggregation, ok := resp.Aggregations.Terms(facetName(i)); ok {
+			for _, bucket := range aggregation.Buckets {
+				element := FacetBucket{Key: bucket.Key, Count: bucket.DocCount}
+				if bucket.KeyAsString != nil {
+					element.KeyAsString = *bucket.KeyAsString
+				}
+				buckets = append(buckets, element)
+			}
+		}
+		result[facet.Feature] = buckets
+	}
+	return result, nil
+}
+
+func facetName(index int) string {
+	return "facet_" + strconv.Itoa(index)
+}
+
+// dateHistogramAggregation uses calendar_interval for elasticsearch >= 7, where interval is deprecated
+type dateHistogramAggregation struct {
+	field    string
+	interval string
+}
+
+func (this dateHistogramAggregation) Source() (interface{}, error) {
+	intervalKey := "interval"
+	if elasticTypeless {
+		intervalKey = "calendar_interval"
+	}
+	return map[string]interface{}{
+		"date_histogram": map[string]interface{}{
+			"field":         this.field,
+			intervalKey:     this.interval,
+			"min_doc_count": 1,
+		},
+	}, nil
+}
+
+func (this *ElasticStorage) PutDeadLetter(ctx context.Context, letter DeadLetter) error {
+	_, err := this.client.Index().Index(DeadLetterIndex).Type(documentType()).Id(letter.Id).BodyJson(letter).Do(ctx)
+	return err
+}
+
+func (this *ElasticStorage) GetDeadLetter(ctx context.Context, id string) (letter DeadLetter, err error) {
+	resp, err := this.client.Get().Index(DeadLetterIndex).Type(documentType()).Id(id).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return letter, ErrNotFound
+	}
+	if err != nil {
+		return letter, err
+	}
+	err = json.Unmarshal(*resp.Source, &letter)
+	return
+}
+
+func (this *ElasticStorage) ListDeadLetters(ctx context.Context, limit int, offset int) (result []DeadLetter, err error) {
+	resp, err := this.search(DeadLetterIndex).Sort("time", true).Sort("id", true).From(offset).Size(limit).Do(ctx)
+	if err != nil {
+		return result, err
+	}
+	result = []DeadLetter{}
+	for _, hit := range resp.Hits.Hits {
+		letter := DeadLetter{}
+		if err = json.Unmarshal(*hit.Source, &letter); err != nil {
+			return result, err
+		}
+		result = append(result, letter)
+	}
+	return result, nil
+}
+
+func (this *ElasticStorage) DeleteDeadLetter(ctx context.Context, id string) error {
+	_, err := this.client.Delete().Index(DeadLetterIndex).Type(documentType()).Id(id).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// elasticState is the document of a service state; the value is stored but not indexed
+type elasticState struct {
+	Value json.RawMessage `json:"value"`
+}
+
+func (this *ElasticStorage) GetState(ctx context.Context, key string, value interface{}) error {
+	resp, err := this.client.Get().Index(StateIndex).Type(documentType()).Id(key).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	state := elasticState{}
+	if err = json.Unmarshal(*resp.Source, &state); err != nil {
+		return err
+	}
+	return json.Unmarshal(state.Value, value)
+}
+
+func (this *ElasticStorage) PutState(ctx context.Context, key string, value interface{}) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = this.client.Index().Index(StateIndex).Type(documentType()).Id(key).BodyJson(elasticState{Value: encoded}).Refresh("true").Do(ctx)
+	return err
+}
+
+func (this *ElasticStorage) search(kind string) *elastic.SearchService {
+	if elasticTypeless {
+		return this.client.Search().Index(kind)
+	}
+	return this.client.Search().Index(kind).Type(ElasticPermissionType)
+}
+
+func (this *ElasticStorage) hitsToEntries(hits []*elastic.SearchHit) (result []Entry, err error) {
+	result = []Entry{}
+	versioned, err := this.hitsToVersionedEntries(hits)
+	for _, element := range versioned {
+		result = append(result, element.Entry)
+	}
+	return
+}
+
+func (this *ElasticStorage) hitsToVersionedEntries(hits []*elastic.SearchHit) (result []VersionedEntry, err error) {
+	result = []VersionedEntry{}
+	for _, hit := range hits {
+		//typeless indices may still contain documents of the "resource" type created by elasticsearch 6
+		if !elasticTypeless && hit.Type != ElasticPermissionType {
+			log.Println("DEBUG: unknown type", hit.Type)
+			continue
+		}
+		entry := Entry{}
+		err = json.Unmarshal(*hit.Source, &entry)
+		if err != nil {
+			return result, err
+		}
+		for field, fragments := range hit.Highlight {
+			if entry.Highlight == nil {
+				entry.Highlight = map[string][]string{}
+			}
+			entry.Highlight[strings.TrimPrefix(field, "features.")] = fragments
+		}
+		result = append(result, VersionedEntry{Entry: entry, Version: elasticVersion(hit.Version, hit.SeqNo, hit.PrimaryTerm)})
+	}
+	return
+}
+
+// elasticVersion returns the sequence number and primary term for optimistic locking if requested (typeless mode)
+// and the internal version otherwise; elasticsearch >= 7 rejects writes with internal versions.
+// The Mapping-Migration reindexes with external versions, which keeps the _version of the entries but not their sequence numbers,
+// so sequence numbers read from the index before the alias swap usually no longer match afterwards and the write is retried.
+func elasticVersion(version *int64, seqNo *int64, primaryTerm *int64) (result Version) {
+	if seqNo != nil && primaryTerm != nil && *primaryTerm > 0 {
+		return Version{Number: *seqNo, PrimaryTerm: *primaryTerm}
+	}
+	if version != nil {
+		result.Number = *version
+	}
+	return
+}
+
+func buildElasticQuery(query SearchQuery) (result *elastic.BoolQuery, err error) {
+	filter := getRightsQuery(query.Rights, query.User, query.Groups)
+	if query.Ids != nil {
+		filter = append(filter, elastic.NewTermsQuery("resource", interfaceSlice(query.Ids)...))
+	}
+	if query.Selection != nil {
+		selection, err := query.Selection.GetFilter()
+		if err != nil {
+			return result, err
+		}
+		filter = append(filter, selection)
+	}
+	result = elastic.NewBoolQuery().Filter(filter...)
+	if query.Text != "" {
+		result = result.Must(query.TextOptions.elasticQuery(query.TextFeature, query.Text))
+	}
+	return result, nil
+}
+
+func getRightsQuery(rights string, user string, groups []string) (result []elastic.Query) {
+	for _, right := range rights {
+		switch right {
+		case 'a':
+			or := []elastic.Query{}
+			if user != "" {
+				or = append(or, elastic.NewTermQuery("admin_users", user))
+			}
+			if len(groups) > 0 {
+				or = append(or, elastic.NewTermsQuery("admin_groups", interfaceSlice(groups)...))
+			}
+			result = append(result, elastic.NewBoolQuery().Filter(elastic.NewBoolQuery().Should(or...)))
+		case 'r':
+			or := []elastic.Query{}
+			if user != "" {
+				or = append(or, elastic.NewTermQuery("read_users", user))
+			}
+			if len(groups) > 0 {
+				or = append(or, elastic.NewTermsQuery("read_groups", interfaceSlice(groups)...))
+			}
+			result = append(result, elastic.NewBoolQuery().Filter(elastic.NewBoolQuery().Should(or...)))
+		case 'w':
+			or := []elastic.Query{}
+			if user != "" {
+				or = append(or, elastic.NewTermQuery("write_users", user))
+			}
+			if len(groups) > 0 {
+				or = append(or, elastic.NewTermsQuery("write_groups", interfaceSlice(groups)...))
+			}
+			result = append(result, elastic.NewBoolQuery().Filter(elastic.NewBoolQuery().Should(or...)))
+		case 'x':
+			or := []elastic.Query{}
+			if user != "" {
+				or = append(or, elastic.NewTermQuery("execute_users", user))
+			}
+			if len(groups) > 0 {
+				or = append(or, elastic.NewTermsQuery("execute_groups", interfaceSlice(groups)...))
+			}
+			result = append(result, elastic.NewBoolQuery().Filter(elastic.NewBoolQuery().Should(or...)))
+		}
+	}
+	return
+}
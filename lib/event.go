@@ -20,28 +20,24 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
-
-	"github.com/SmartEnergyPlatform/amqp-wrapper-lib"
 )
 
-var conn *amqp_wrapper_lib.Connection
-
 func InitEventHandling() (err error) {
-	conn, err = amqp_wrapper_lib.Init(Config.AmqpUrl, append(Config.ResourceList, Config.PermTopic, Config.UserTopic), Config.AmqpReconnectTimeout)
+	transport, err := GetTransport()
 	if err != nil {
-		log.Fatal("ERROR: while initializing amqp connection", err)
+		log.Fatal("ERROR: while initializing event transport ", err)
 		return
 	}
 
 	log.Println("init permissions handler")
-	err = conn.Consume(Config.AmqpConsumerName+"_"+Config.PermTopic, Config.PermTopic, handlePermissionCommand)
+	err = transport.Subscribe(consumerGroup(Config.PermTopic), Config.PermTopic, deadLetterHandler(Config.PermTopic, handlePermissionCommand))
 	if err != nil {
 		log.Fatal("ERROR: while initializing perm consumer", err)
 		return
 	}
 
 	log.Println("init user handler")
-	err = conn.Consume(Config.AmqpConsumerName+"_"+Config.UserTopic, Config.UserTopic, handleUserCommand)
+	err = transport.Subscribe(consumerGroup(Config.UserTopic), Config.UserTopic, deadLetterHandler(Config.UserTopic, handleUserCommand))
 	if err != nil {
 		log.Fatal("ERROR: while initializing user consumer", err)
 		return
@@ -49,12 +45,21 @@ func InitEventHandling() (err error) {
 
 	log.Println("init features handler", Config.ResourceList)
 	for _, resource := range Config.ResourceList {
-		err = conn.Consume(Config.AmqpConsumerName+"_"+resource, resource, getResourceCommandHandler(resource))
+		err = transport.Subscribe(consumerGroup(resource), resource, deadLetterHandler(resource, getResourceCommandHandler(resource)))
 		if err != nil {
 			log.Fatal("ERROR: while initializing resource consumer ", resource, " ", err)
 			return
 		}
 	}
+
+	if Config.DeadLetterTopic != "" {
+		log.Println("init dead letter handler")
+		err = transport.Subscribe(consumerGroup(Config.DeadLetterTopic), Config.DeadLetterTopic, handleDeadLetter)
+		if err != nil {
+			log.Fatal("ERROR: while initializing dead letter consumer", err)
+			return
+		}
+	}
 	return
 }
 
@@ -63,7 +68,7 @@ func handlePermissionCommand(msg []byte) (err error) {
 	command := PermCommandMsg{}
 	err = json.Unmarshal(msg, &command)
 	if err != nil {
-		return
+		return UnprocessableEventError{Err: err}
 	}
 	switch command.Command {
 	case "PUT":
@@ -81,7 +86,7 @@ func handlePermissionCommand(msg []byte) (err error) {
 			return DeleteGroupRight(command.Kind, command.Resource, command.Group)
 		}
 	}
-	return errors.New("unable to handle permission command: " + string(msg))
+	return UnprocessableEventError{Err: errors.New("unable to handle permission command: " + string(msg))}
 }
 
 func handleUserCommand(msg []byte) (err error) {
@@ -89,7 +94,7 @@ func handleUserCommand(msg []byte) (err error) {
 	command := UserCommandMsg{}
 	err = json.Unmarshal(msg, &command)
 	if err != nil {
-		return
+		return UnprocessableEventError{Err: err}
 	}
 	switch command.Command {
 	case "DELETE":
@@ -97,24 +102,27 @@ func handleUserCommand(msg []byte) (err error) {
 			return DeleteUser(command.Id)
 		}
 	}
-	log.Println("WARNING: unable to handle user command: " + string(msg))
-	return nil
+	return UnprocessableEventError{Err: errors.New("unable to handle user command: " + string(msg))}
 }
 
-func getResourceCommandHandler(resourceName string) amqp_wrapper_lib.ConsumerFunc {
+func getResourceCommandHandler(resourceName string) TransportHandler {
 	return func(msg []byte) (err error) {
 		command := CommandWrapper{}
 		err = json.Unmarshal(msg, &command)
 		if err != nil {
-			return
+			return UnprocessableEventError{Err: err}
 		}
 		switch command.Command {
 		case "PUT":
 			return UpdateFeatures(resourceName, msg, command)
 		case "DELETE":
-			return DeleteFeatures(resourceName, command)
+			version, versioned, err := eventVersion(resourceName, msg)
+			if err != nil {
+				return UnprocessableEventError{Err: err}
+			}
+			return deleteFeatures(resourceName, command, version, versioned)
 		}
-		return errors.New("unable to handle command: " + resourceName + " " + string(msg))
+		return UnprocessableEventError{Err: errors.New("unable to handle command: " + resourceName + " " + string(msg))}
 	}
 }
 
@@ -124,6 +132,10 @@ func sendEvent(topic string, event interface{}) error {
 		log.Println("ERROR: event marshaling:", err)
 		return err
 	}
-	log.Println("DEBUG: send amqp event: ", topic, string(payload))
-	return conn.Publish(topic, payload)
+	log.Println("DEBUG: send event: ", topic, string(payload))
+	transport, err := GetTransport()
+	if err != nil {
+		return err
+	}
+	return transport.Publish(topic, payload)
 }
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// eventVersion reads the version of a resource event at the VersionPath of the kind;
+// numbers are parsed as int64 without the precision loss of float64, strings may be integers or RFC 3339 timestamps (as unix nanoseconds).
+// ok is false if the kind has no VersionPath or the event carries no version.
+func eventVersion(kind string, msg []byte) (version int64, ok bool, err error) {
+	path := Config.Resources[kind].VersionPath
+	if path == "" {
+		return 0, false, nil
+	}
+	value, err := useJsonPath(msg, path, true)
+	if err != nil {
+		return 0, false, err
+	}
+	switch v := value.(type) {
+	case nil:
+		return 0, false, nil
+	case json.Number:
+		if version, err = v.Int64(); err == nil {
+			return version, true, nil
+		}
+		//integral numbers in float notation like 2.0 or 1e3
+		float, err := v.Float64()
+		if err != nil || float != math.Trunc(float) || math.Abs(float) >= math.MaxInt64 {
+			return 0, false, fmt.Errorf("version %v of %v is not an integer", v, kind)
+		}
+		return int64(float), true, nil
+	case string:
+		if version, err = strconv.ParseInt(v, 10, 64); err == nil {
+			return version, true, nil
+		}
+		timestamp, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return 0, false, errors.New("version " + v + " of " + kind + " is neither an integer nor a RFC 3339 timestamp")
+		}
+		return timestamp.UnixNano(), true, nil
+	}
+	return 0, false, fmt.Errorf("unexpected version %v of %v", value, kind)
+}
+
+// isStale checks if the event version is older than the version stored on the entry
+func isStale(entry Entry, version int64, ok bool) bool {
+	return ok && version < entry.EventVersion
+}
+
+var staleEvents = map[string]int64{}
+var staleEventsMux sync.Mutex
+
+// discardStaleEvent counts and logs an event which is older than the stored entry
+func discardStaleEvent(kind string, resource string, command string, version int64, stored int64) {
+	staleEventsMux.Lock()
+	staleEvents[kind]++
+	count := staleEvents[kind]
+	staleEventsMux.Unlock()
+	log.Println("WARNING: discard stale", command, "event of", kind, resource, "version", version, "<", stored, "discarded events of kind:", count)
+}
+
+// StaleEvents returns the number of discarded stale events per kind since the start of the service
+func StaleEvents() map[string]int64 {
+	staleEventsMux.Lock()
+	defer staleEventsMux.Unlock()
+	result := map[string]int64{}
+	for kind, count := range staleEvents {
+		result[kind] = count
+	}
+	return result
+}
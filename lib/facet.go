@@ -0,0 +1,152 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+const defaultFacetInterval = "month"
+
+// Facet describes one aggregation of a storage; with an Interval the values are grouped by date, otherwise by term
+type Facet struct {
+	Feature  string
+	Size     int
+	Interval string
+}
+
+type FacetBucket struct {
+	Key         interface{} `json:"key"`
+	KeyAsString string      `json:"key_as_string,omitempty"`
+	Count       int64       `json:"count"`
+}
+
+// FacetRequest is the body of the facet endpoint; Size limits the terms per feature, Interval groups date features
+type FacetRequest struct {
+	Features  []string   `json:"features"`
+	Selection *Selection `json:"selection"`
+	Size      int        `json:"size"`
+	Interval  string     `json:"interval"`
+}
+
+var facetIntervals = map[string]bool{
+	"year":    true,
+	"quarter": true,
+	"month":   true,
+	"week":    true,
+	"day":     true,
+	"hour":    true,
+	"minute":  true,
+	"second":  true,
+}
+
+func (this FacetRequest) Validate(kind string) error {
+	if len(this.Features) == 0 {
+		return errors.New("missing features")
+	}
+	if this.Size < 0 {
+		return errors.New("invalid size")
+	}
+	if this.Interval != "" && !facetIntervals[this.Interval] {
+		return errors.New("unknown interval " + this.Interval)
+	}
+	for _, feature := range this.Features {
+		mapping, ok := featureMapping(kind, feature)
+		if !ok {
+			return errors.New("feature " + feature + " is not in the ElasticMapping of " + kind)
+		}
+		if mapping["type"] == "text" || mapping["type"] == nil {
+			return errors.New("unable to aggregate text or object feature " + feature)
+		}
+	}
+	if this.Selection != nil {
+		return this.Selection.Validate(kind)
+	}
+	return nil
+}
+
+// GetFacets counts the values of the requested features over all resources the user or groups have the rights for;
+// date mapped features are grouped by Interval (default month), all other features by term
+func GetFacets(kind string, user string, groups []string, rights string, request FacetRequest) (result map[string][]FacetBucket, err error) {
+	if err = validateRights(rights); err != nil {
+		return result, err
+	}
+	facets := []Facet{}
+	for _, feature := range request.Features {
+		facet := Facet{Feature: feature, Size: request.Size}
+		if facet.Size == 0 {
+			facet.Size = defaultSearchSize
+		}
+		if mapping, _ := featureMapping(kind, feature); mapping["type"] == "date" {
+			facet.Interval = request.Interval
+			if facet.Interval == "" {
+				facet.Interval = defaultFacetInterval
+			}
+		}
+		facets = append(facets, facet)
+	}
+	return GetStorage().Facets(context.Background(), kind, SearchQuery{Rights: rights, User: user, Groups: groups, Selection: request.Selection}, facets)
+}
+
+// truncateDate returns the start of the calendar interval containing the time like an elasticsearch date_histogram
+func truncateDate(t time.Time, interval string) time.Time {
+	t = t.UTC()
+	switch interval {
+	case "year":
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	case "quarter":
+		return time.Date(t.Year(), (t.Month()-1)/3*3+1, 1, 0, 0, 0, 0, time.UTC)
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	case "week":
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case "day":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	default:
+		return t.Truncate(facetIntervalDuration(interval))
+	}
+}
+
+func facetIntervalDuration(interval string) time.Duration {
+	switch interval {
+	case "hour":
+		return time.Hour
+	case "minute":
+		return time.Minute
+	}
+	return time.Second
+}
+
+// parseDate reads date values like the default elasticsearch date format strict_date_optional_time||epoch_millis
+func parseDate(value interface{}) (result time.Time, ok bool) {
+	if millis, ok := toFloat(value); ok {
+		return time.Unix(0, int64(millis)*int64(time.Millisecond)).UTC(), true
+	}
+	switch v := value.(type) {
+	case string:
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999", "2006-01-02T15:04", "2006-01-02"} {
+			if result, err := time.Parse(layout, strings.TrimSpace(v)); err == nil {
+				return result, true
+			}
+		}
+	}
+	return result, false
+}
@@ -17,6 +17,7 @@
 package lib
 
 import (
+	"bytes"
 	"encoding/json"
 
 	"github.com/JumboInteractiveLimited/jsonpath"
@@ -34,6 +35,11 @@ func MsgToFeatures(kind string, msg []byte) (result map[string]interface{}, err
 }
 
 func UseJsonPath(msg []byte, path string) (interface{}, error) {
+	return useJsonPath(msg, path, false)
+}
+
+// useJsonPath is UseJsonPath; with useNumber numbers are returned as json.Number instead of float64
+func useJsonPath(msg []byte, path string, useNumber bool) (interface{}, error) {
 	temp := []interface{}{}
 	paths, err := jsonpath.ParsePaths(path)
 	if err != nil {
@@ -46,7 +52,11 @@ func UseJsonPath(msg []byte, path string) (interface{}, error) {
 	for {
 		if element, ok := eval.Next(); ok {
 			var val interface{}
-			err = json.Unmarshal(element.Value, &val)
+			decoder := json.NewDecoder(bytes.NewReader(element.Value))
+			if useNumber {
+				decoder.UseNumber()
+			}
+			err = decoder.Decode(&val)
 			if err != nil {
 				return nil, err
 			}
@@ -0,0 +1,134 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// KafkaTransport reads each subscription with its own consumer group reader; the offset of a message
+// is committed after its handler succeeded, failed messages are handled again after transportRetryPause
+type KafkaTransport struct {
+	brokers []string
+	writer  *kafka.Writer
+	ctx     context.Context
+	cancel  context.CancelFunc
+	mux     sync.Mutex
+	readers []*kafka.Reader
+}
+
+func NewKafkaTransport(brokers []string) *KafkaTransport {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &KafkaTransport{
+		brokers: brokers,
+		writer: &kafka.Writer{
+			Addr:                   kafka.TCP(brokers...),
+			Balancer:               &kafka.Hash{},
+			RequiredAcks:           kafka.RequireAll,
+			AllowAutoTopicCreation: true,
+		},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func (this *KafkaTransport) Subscribe(group string, topic string, handler TransportHandler) error {
+	log.Println("init kafka consumer", group, "for", topic)
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:  this.brokers,
+		GroupID:  group,
+		Topic:    topic,
+		MaxWait:  time.Second,
+		MinBytes: 1,
+		MaxBytes: 10e6,
+	})
+	this.mux.Lock()
+	this.readers = append(this.readers, reader)
+	this.mux.Unlock()
+	go this.consume(topic, reader, handler)
+	return nil
+}
+
+func (this *KafkaTransport) consume(topic string, reader *kafka.Reader, handler TransportHandler) {
+	for {
+		msg, err := reader.FetchMessage(this.ctx)
+		if err != nil {
+			if this.ctx.Err() != nil {
+				return
+			}
+			log.Println("ERROR: while fetching kafka message of", topic, err)
+			time.Sleep(transportRetryPause)
+			continue
+		}
+		for {
+			err = handler(msg.Value)
+			if err == nil {
+				break
+			}
+			log.Println("error while processing msg; message consumption will not be committed", err)
+			select {
+			case <-this.ctx.Done():
+				return
+			case <-time.After(transportRetryPause):
+			}
+		}
+		if err = reader.CommitMessages(this.ctx, msg); err != nil && this.ctx.Err() == nil {
+			log.Println("ERROR: while committing kafka message of", topic, err)
+		}
+	}
+}
+
+// Publish keys the message with messageKey, so that the Hash balancer spreads the resources over the partitions
+// while all events of one resource stay in order on the same partition
+func (this *KafkaTransport) Publish(topic string, payload []byte) error {
+	return this.writer.WriteMessages(this.ctx, kafka.Message{Topic: topic, Key: messageKey(payload), Value: payload})
+}
+
+// messageKey returns the resource of permission commands and change notifications or the id of resource and user commands;
+// nil for payloads without either, which are distributed round-robin
+func messageKey(payload []byte) []byte {
+	ids := struct {
+		Resource string `json:"resource"`
+		Id       string `json:"id"`
+	}{}
+	if json.Unmarshal(payload, &ids) != nil {
+		return nil
+	}
+	if ids.Resource != "" {
+		return []byte(ids.Resource)
+	}
+	if ids.Id != "" {
+		return []byte(ids.Id)
+	}
+	return nil
+}
+
+func (this *KafkaTransport) Close() {
+	log.Println("close kafka transport")
+	this.cancel()
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	for _, reader := range this.readers {
+		reader.Close()
+	}
+	this.writer.Close()
+}
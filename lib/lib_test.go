@@ -18,23 +18,30 @@ package lib
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 
 	"context"
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
-	"reflect"
-
+	"github.com/SmartEnergyPlatform/jwt-http-router"
 	"github.com/olivere/elastic"
 )
 
 func Example() {
-	err := LoadConfig("./../config.json")
+	err := loadTestConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
-	Config.ElasticUrl = "http://localhost:9200"
-	Config.ElasticRetry = 3
 	test, testCmd := getDtTestObj("test", map[string]interface{}{
 		"name":        "test",
 		"description": "desc",
@@ -71,14 +78,7 @@ func Example() {
 		"services":    []map[string]interface{}{},
 		"vendor":      map[string]interface{}{"name": "vendor"},
 	})
-	_, err = GetClient().DeleteByQuery("devicetype").Query(elastic.NewMatchAllQuery()).Do(context.Background())
-	if err != nil {
-		panic(err)
-	}
-	_, err = client.Flush().Index("devicetype").Do(context.Background())
-	if err != nil {
-		panic(err)
-	}
+	SetStorage(NewMemoryStorage())
 	err = UpdateFeatures("devicetype", test, testCmd)
 	if err != nil {
 		log.Fatal(err)
@@ -99,10 +99,6 @@ func Example() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	_, err = client.Flush().Index("devicetype").Do(context.Background())
-	if err != nil {
-		panic(err)
-	}
 	e, err := GetResourceEntry("devicetype", "test")
 	fmt.Println(err, e.Resource)
 	e, err = GetResourceEntry("devicetype", "foo1")
@@ -119,7 +115,7 @@ func Example() {
 	//<nil> foo1
 	//<nil> foo2
 	//<nil> zway
-	//elastic: Error 404 (Not Found)
+	//not found
 }
 
 func getDtTestObj(id string, dt map[string]interface{}) (msg []byte, command CommandWrapper) {
@@ -141,49 +137,34 @@ func getDtTestObj(id string, dt map[string]interface{}) (msg []byte, command Com
 	return
 }
 
-func ExampleSearch() {
-	Example()
-	_, err := client.Flush().Index("devicetype").Do(context.Background())
-	if err != nil {
-		panic(err)
-	}
-	query := elastic.NewBoolQuery().Should(
-		elastic.NewTermQuery("admin_users", "testOwner"),
-		elastic.NewTermQuery("read_users", "testOwner"),
-		elastic.NewTermQuery("write_users", "testOwner"),
-		elastic.NewTermQuery("execute_users", "testOwner"))
-	result, err := GetClient().Search().Index("devicetype").Type(ElasticPermissionType).Query(query).Do(context.Background())
+func Example_search() {
+	initDb()
+	query := Selection{Or: []Selection{
+		{Condition: ConditionConfig{Feature: "admin_users", Operation: QueryEqualOperation, Value: "testOwner"}},
+		{Condition: ConditionConfig{Feature: "read_users", Operation: QueryEqualOperation, Value: "testOwner"}},
+		{Condition: ConditionConfig{Feature: "write_users", Operation: QueryEqualOperation, Value: "testOwner"}},
+		{Condition: ConditionConfig{Feature: "execute_users", Operation: QueryEqualOperation, Value: "testOwner"}},
+	}}
+	result, err := GetStorage().Search(context.Background(), "devicetype", SearchQuery{Selection: &query})
 	fmt.Println(err)
 
-	var entity Entry
-	if result != nil {
-		for _, item := range result.Each(reflect.TypeOf(entity)) {
-			if t, ok := item.(Entry); ok {
-				fmt.Println(t.Resource)
-			}
-		}
+	for _, t := range result.Hits {
+		fmt.Println(t.Resource)
 	}
 
 	//Output:
-	//<nil> test
-	//<nil> foo1
-	//<nil> foo2
-	//<nil> zway
-	//elastic: Error 404 (Not Found)
 	//<nil>
-	//foo2
 	//foo1
+	//foo2
 	//test
 	//zway
 }
 
 func ExampleDeleteUser() {
-	err := LoadConfig("./../config.json")
+	err := loadTestConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
-	Config.ElasticUrl = "http://localhost:9200"
-	Config.ElasticRetry = 3
 	msg, cmd := getDtTestObj("del", map[string]interface{}{
 		"name":        "ZWay-SwitchMultilevel",
 		"description": "desc",
@@ -191,14 +172,7 @@ func ExampleDeleteUser() {
 		"services":    []map[string]interface{}{},
 		"vendor":      map[string]interface{}{"name": "vendor"},
 	})
-	_, err = GetClient().DeleteByQuery("devicetype").Query(elastic.NewMatchAllQuery()).Do(context.Background())
-	if err != nil {
-		panic(err)
-	}
-	_, err = client.Flush().Index("devicetype").Do(context.Background())
-	if err != nil {
-		panic(err)
-	}
+	SetStorage(NewMemoryStorage())
 	err = UpdateFeatures("devicetype", msg, cmd)
 	if err != nil {
 		log.Fatal(err)
@@ -211,34 +185,22 @@ func ExampleDeleteUser() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	_, err = client.Flush().Index("devicetype").Do(context.Background())
-	if err != nil {
-		panic(err)
-	}
-	query := elastic.NewMatchAllQuery()
-	result, err := GetClient().Search().Index("devicetype").Type(ElasticPermissionType).Query(query).Do(context.Background())
+	result, err := GetStorage().Search(context.Background(), "devicetype", SearchQuery{})
 	fmt.Println(err)
-	var entity Entry
-	if result != nil {
-		for _, item := range result.Each(reflect.TypeOf(entity)) {
-			if t, ok := item.(Entry); ok {
-				fmt.Println(t.Resource, t.ReadUsers, t.WriteUsers, t.ExecuteUsers, t.AdminUsers, t.ReadGroups, t.WriteGroups, t.ExecuteGroups, t.AdminGroups)
-			}
-		}
+	for _, t := range result.Hits {
+		fmt.Println(t.Resource, t.ReadUsers, t.WriteUsers, t.ExecuteUsers, t.AdminUsers, t.ReadGroups, t.WriteGroups, t.ExecuteGroups, t.AdminGroups)
 	}
 
 	//Output:
 	//<nil>
-	//del [testOwner] [testOwner] [testOwner] [testOwner] [admin] [admin] [admin] [admin]
+	//del [] [] [] [] [admin] [admin] [admin] [admin]
 }
 
 func ExampleDeleteFeatures() {
-	err := LoadConfig("./../config.json")
+	err := loadTestConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
-	Config.ElasticUrl = "http://localhost:9200"
-	Config.ElasticRetry = 3
 	msg, cmd := getDtTestObj("del1", map[string]interface{}{
 		"name":        "ZWay-SwitchMultilevel",
 		"description": "desc",
@@ -254,14 +216,7 @@ func ExampleDeleteFeatures() {
 		"services":    []map[string]interface{}{},
 		"vendor":      map[string]interface{}{"name": "vendor"},
 	})
-	_, err = GetClient().DeleteByQuery("devicetype").Query(elastic.NewMatchAllQuery()).Do(context.Background())
-	if err != nil {
-		panic(err)
-	}
-	_, err = client.Flush().Index("devicetype").Do(context.Background())
-	if err != nil {
-		panic(err)
-	}
+	SetStorage(NewMemoryStorage())
 	err = UpdateFeatures("devicetype", msg, cmd)
 	if err != nil {
 		log.Fatal(err)
@@ -270,20 +225,10 @@ func ExampleDeleteFeatures() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	_, err = client.Flush().Index("devicetype").Do(context.Background())
-	if err != nil {
-		panic(err)
-	}
-	query := elastic.NewMatchAllQuery()
-	result, err := GetClient().Search().Index("devicetype").Type(ElasticPermissionType).Query(query).Do(context.Background())
+	result, err := GetStorage().Search(context.Background(), "devicetype", SearchQuery{})
 	fmt.Println(err)
-	var entity Entry
-	if result != nil {
-		for _, item := range result.Each(reflect.TypeOf(entity)) {
-			if t, ok := item.(Entry); ok {
-				fmt.Println(t.Resource)
-			}
-		}
+	for _, t := range result.Hits {
+		fmt.Println(t.Resource)
 	}
 
 	//Output:
@@ -325,12 +270,10 @@ func ExampleGetRightsToAdministrate() {
 }
 
 func ExampleCheckUserOrGroup() {
-	err := LoadConfig("./../config.json")
+	err := loadTestConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
-	Config.ElasticUrl = "http://localhost:9200"
-	Config.ElasticRetry = 3
 	test, testCmd := getDtTestObj("check3", map[string]interface{}{
 		"name":        "test",
 		"description": "desc",
@@ -338,20 +281,8 @@ func ExampleCheckUserOrGroup() {
 		"services":    []map[string]interface{}{{"id": "serviceTest1"}, {"id": "serviceTest2"}},
 		"vendor":      map[string]interface{}{"name": "vendor"},
 	})
-	_, err = GetClient().DeleteByQuery("devicetype").Query(elastic.NewMatchAllQuery()).Do(context.Background())
-	if err != nil {
-		panic(err)
-	}
-	_, err = client.Flush().Index("devicetype").Do(context.Background())
-	if err != nil {
-		panic(err)
-	}
+	SetStorage(NewMemoryStorage())
 	UpdateFeatures("devicetype", test, testCmd)
-	if err != nil {
-		log.Fatal(err)
-	}
-	_, err = client.Flush().Index("devicetype").Do(context.Background())
-
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -387,9 +318,9 @@ func ExampleGetFullListForUserOrGroup() {
 	//Output:
 	//<nil>
 	//foo1
+	//foo2
 	//test
 	//ZWay-SwitchMultilevel
-	//foo2
 }
 
 func ExampleGetListForUserOrGroup() {
@@ -413,15 +344,15 @@ func ExampleGetListForUserOrGroup() {
 	//Output:
 	//<nil>
 	//foo1
+	//foo2
 	//test
 	//ZWay-SwitchMultilevel
-	//foo2
 	//<nil>
 	//foo1
+	//foo2
 	//test
-	//ZWay-SwitchMultilevel
 	//<nil>
-	//foo2
+	//ZWay-SwitchMultilevel
 }
 
 func ExampleGetOrderedListForUserOrGroup() {
@@ -541,7 +472,7 @@ func ExampleSelectByFieldAll() {
 	//<nil>
 }
 
-func ExampleJsonpath() {
+func Example_jsonpath() {
 	jsonStr := `{  
    "command":"PUT",
    "processmodel":{  
@@ -1033,19 +964,31 @@ func ExampleJsonpath() {
    "id":"5b0812f2d10ea4001614e002"
 }`
 
-	fmt.Println(UseJsonPath([]byte(jsonStr), "$.processmodel.svg+"))
+	svg, err := UseJsonPath([]byte(jsonStr), "$.processmodel.svg+")
+	_, ok := svg.(map[string]interface{})
+	fmt.Println(err, ok)
 
 	//Output:
-	//
+	//<nil> true
 }
 
-func initDb() {
+// loadTestConfig loads the config with the memory storage and the channel transport, so that no example needs elasticsearch or a broker
+func loadTestConfig() error {
 	err := LoadConfig("./../config.json")
+	if err != nil {
+		return err
+	}
+	Config.Storage = "memory"
+	Config.Transport = "channel"
+	SetTransport(NewChannelTransport())
+	return nil
+}
+
+func initDb() {
+	err := loadTestConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
-	Config.ElasticUrl = "http://localhost:9200"
-	Config.ElasticRetry = 3
 	test, testCmd := getDtTestObj("test", map[string]interface{}{
 		"name":        "test",
 		"description": "desc",
@@ -1083,14 +1026,7 @@ func initDb() {
 		"vendor":      map[string]interface{}{"name": "vendor"},
 	})
 
-	_, err = GetClient().DeleteByQuery("devicetype").Query(elastic.NewMatchAllQuery()).Do(context.Background())
-	if err != nil {
-		panic(err)
-	}
-	_, err = client.Flush().Index("devicetype").Do(context.Background())
-	if err != nil {
-		panic(err)
-	}
+	SetStorage(NewMemoryStorage())
 	err = UpdateFeatures("devicetype", test, testCmd)
 	if err != nil {
 		log.Fatal(err)
@@ -1112,8 +1048,1531 @@ func initDb() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	_, err = client.Flush().Index("devicetype").Do(context.Background())
+}
+
+func Example_mappingContains() {
+	live := map[string]interface{}{"properties": map[string]interface{}{
+		"name":    map[string]interface{}{"type": "keyword", "copy_to": []interface{}{"feature_search"}},
+		"dynamic": map[string]interface{}{"type": "text"},
+	}}
+	fmt.Println(mappingContains(live, map[string]interface{}{"properties": map[string]interface{}{
+		"name": map[string]interface{}{"type": "keyword", "copy_to": "feature_search"},
+	}}))
+	fmt.Println(mappingContains(live, map[string]interface{}{"properties": map[string]interface{}{
+		"name": map[string]interface{}{"type": "text", "copy_to": "feature_search"},
+	}}))
+	fmt.Println(mappingContains(live, map[string]interface{}{"properties": map[string]interface{}{
+		"vendor": map[string]interface{}{"type": "keyword"},
+	}}))
+
+	//Output:
+	//true
+	//false
+	//false
+}
+
+func Example_createMappingTypeless() {
+	err := LoadConfig("./../config.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	elasticTypeless = false
+	mapping, err := createMapping("devicetype")
+	_, typed := mapping["mappings"].(map[string]interface{})[ElasticPermissionType]
+	fmt.Println(err, typed)
+
+	elasticTypeless = true
+	mapping, err = createMapping("devicetype")
+	_, typeless := mapping["mappings"].(map[string]interface{})["properties"]
+	fmt.Println(err, typeless)
+	elasticTypeless = false
+
+	//Output:
+	//<nil> true
+	//<nil> true
+}
+
+type conflictStorage struct {
+	*MemoryStorage
+	conflicts int
+}
+
+func (this *conflictStorage) Put(ctx context.Context, kind string, entry Entry, version Version) error {
+	if version.IsSet() && this.conflicts > 0 {
+		this.conflicts--
+		return ErrVersionConflict
+	}
+	return this.MemoryStorage.Put(ctx, kind, entry, version)
+}
+
+func ExampleSetGroupRight() {
+	initDb()
+	Config.VersionConflictRetry = 2
+	storage := &conflictStorage{MemoryStorage: GetStorage().(*MemoryStorage), conflicts: 2}
+	SetStorage(storage)
+
+	err := SetGroupRight("devicetype", "foo1", "tester", "r")
+	fmt.Println(err, CheckGroups("devicetype", "foo1", []string{"tester"}, "r"))
+
+	storage.conflicts = 3
+	err = SetGroupRight("devicetype", "foo2", "tester", "r")
+	fmt.Println(err, IsVersionConflict(err), CheckGroups("devicetype", "foo2", []string{"tester"}, "r"))
+
+	//Output:
+	//<nil> <nil>
+	//version conflict on devicetype foo2 after 3 attempts true access denied
+}
+
+// concurrentBulkStorage applies every bulk update as a concurrent writer would and reports it as version conflict
+type concurrentBulkStorage struct {
+	*MemoryStorage
+}
+
+func (this *concurrentBulkStorage) PutBulk(ctx context.Context, kind string, entries []VersionedEntry) (conflicts []string, err error) {
+	for _, element := range entries {
+		if err = this.MemoryStorage.Put(ctx, kind, element.Entry, Version{}); err != nil {
+			return conflicts, err
+		}
+		conflicts = append(conflicts, element.Entry.Resource)
+	}
+	return conflicts, nil
+}
+
+func Example_updateAllEntries() {
+	initDb()
+	SetStorage(&concurrentBulkStorage{MemoryStorage: GetStorage().(*MemoryStorage)})
+
+	//the retried entries are already changed and not written again
+	changed, err := updateAllEntries(context.Background(), "devicetype", false, func(entry *Entry) bool {
+		return applyGroupRights(entry, map[string]string{"tester": "r"})
+	})
+	fmt.Println(err, changed, CheckGroups("devicetype", "foo1", []string{"tester"}, "r"))
+
+	//Output:
+	//<nil> 0 <nil>
+}
+
+func ExampleElasticStorage_Put() {
+	typeless := elasticTypeless
+	defer func() { elasticTypeless = typeless }()
+	stored := `{"_index": "devicetype_v2", "_type": "_doc", "_id": "foo", "_version": 5, "_seq_no": 12, "_primary_term": 3, "found": true, "_source": {"resource": "foo"}}`
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Method == "GET" {
+			res.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(res, stored)
+			return
+		}
+		fmt.Println(req.Method, req.URL.Path, req.URL.RawQuery)
+		res.Header().Set("Content-Type", "application/json")
+		if req.URL.Query().Get("if_seq_no") == "11" || req.URL.Query().Get("op_type") == "create" {
+			res.WriteHeader(http.StatusConflict)
+			fmt.Fprint(res, `{"error": {"type": "version_conflict_engine_exception"}, "status": 409}`)
+			return
+		}
+		fmt.Fprint(res, `{"_index": "devicetype_v2", "_id": "foo", "result": "updated"}`)
+	}))
+	defer server.Close()
+	client, err := elastic.NewClient(elastic.SetURL(server.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	storage := NewElasticStorage(client)
+	ctx := context.Background()
+
+	//typeless writes expect the sequence number and primary term of the read
+	elasticTypeless = true
+	entry, version, err := storage.Get(ctx, "devicetype", "foo")
+	fmt.Println(err, version)
+	fmt.Println(storage.Put(ctx, "devicetype", entry, version))
+	fmt.Println(storage.Put(ctx, "devicetype", entry, Version{Number: 11, PrimaryTerm: 3}))
+	fmt.Println(storage.Delete(ctx, "devicetype", "foo", version))
+
+	//creates are rejected if the id exists
+	fmt.Println(storage.Create(ctx, "devicetype", entry))
+
+	//elasticsearch 6 returns no sequence number without request, so the internal version is used
+	elasticTypeless = false
+	stored = `{"_index": "devicetype_v2", "_type": "resource", "_id": "foo", "_version": 5, "found": true, "_source": {"resource": "foo"}}`
+	entry, version, err = storage.Get(ctx, "devicetype", "foo")
+	fmt.Println(err, version)
+	fmt.Println(storage.Put(ctx, "devicetype", entry, version))
+
+	//Output:
+	//<nil> {12 3}
+	//PUT /devicetype/_doc/foo if_primary_term=3&if_seq_no=12
+	//<nil>
+	//PUT /devicetype/_doc/foo if_primary_term=3&if_seq_no=11
+	//version conflict
+	//DELETE /devicetype/_doc/foo if_primary_term=3&if_seq_no=12
+	//<nil>
+	//PUT /devicetype/_doc/foo op_type=create
+	//version conflict
+	//<nil> {5 0}
+	//PUT /devicetype/resource/foo version=5
+	//<nil>
+}
+
+func ExampleElasticStorage_Search_highlight() {
+	initDb()
+	typeless := elasticTypeless
+	defer func() { elasticTypeless = typeless }()
+	elasticTypeless = true
+	client, stop, err := newFakeElasticClient(func(req *http.Request, body string) (int, string) {
+		request := struct {
+			Highlight struct {
+				PreTags           []string                          `json:"pre_tags"`
+				PostTags          []string                          `json:"post_tags"`
+				NumberOfFragments int                               `json:"number_of_fragments"`
+				Fields            map[string]map[string]interface{} `json:"fields"`
+			} `json:"highlight"`
+		}{}
+		json.Unmarshal([]byte(body), &request)
+		fields := []string{}
+		for field, options := range request.Highlight.Fields {
+			if options["highlight_query"] != nil {
+				fields = append(fields, field)
+			}
+		}
+		sort.Strings(fields)
+		fmt.Println(request.Highlight.PreTags, request.Highlight.PostTags, request.Highlight.NumberOfFragments, fields)
+		return http.StatusOK, `{"hits": {"total": 1, "hits": [{"_index": "devicetype_v1", "_type": "_doc", "_id": "lamp", "_version": 1,
+			"_source": {"resource": "lamp", "features": {"name": "Kitchen Lamp"}},
+			"highlight": {"features.name": ["<em>Kitchen</em> Lamp"], "features.description": ["dimmable lamp for the <em>kitchen</em>"]}}]}}`
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer stop()
+	storage := NewElasticStorage(client)
+	query := SearchQuery{Rights: "r", User: "testOwner", Text: "kitchen", TextOptions: TextOptions{Highlight: true}, Projection: &Projection{Includes: []string{"name"}}}
+	result, err := storage.Search(context.Background(), "devicetype", query)
+	fmt.Println(err, result.Hits[0].Features, result.Hits[0].Highlight)
+
+	//Output:
+	//[<em>] [</em>] 0 [features.description features.name features.vendor]
+	//<nil> map[name:Kitchen Lamp] map[description:[dimmable lamp for the <em>kitchen</em>] name:[<em>Kitchen</em> Lamp]]
+}
+
+// newFakeElasticClient returns a client of a fake elasticsearch which answers each request with respond
+func newFakeElasticClient(respond func(req *http.Request, body string) (status int, response string)) (*elastic.Client, func(), error) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		status, response := respond(req, string(body))
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(status)
+		fmt.Fprint(res, response)
+	}))
+	client, err := elastic.NewClient(elastic.SetURL(server.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false), elastic.SetDecoder(&elastic.NumberDecoder{}))
+	return client, server.Close, err
+}
+
+func Example_analysisChanged() {
+	initDb()
+	analysis := `"analysis": {
+		"filter": {"autocomplete_filter": {"type": "edge_ngram", "min_gram": "1", "max_gram": "20"}},
+		"analyzer": {"autocomplete": {"type": "custom", "tokenizer": "standard", "filter": ["lowercase", "autocomplete_filter"]}}
+		%v
+	}`
+	live := ""
+	client, stop, err := newFakeElasticClient(func(req *http.Request, body string) (int, string) {
+		return http.StatusOK, `{"devicetype_v1": {"settings": {"index": {"number_of_shards": "5", ` + live + `}}}}`
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer stop()
+	mapping, _ := createMapping("devicetype")
+
+	live = fmt.Sprintf(analysis, `, "normalizer": {"lowercase_normalizer": {"type": "custom", "filter": ["lowercase"]}}`)
+	fmt.Println(analysisChanged(context.Background(), client, "devicetype_v1", mapping["settings"]))
+	//index created before the lowercase_sort option
+	live = fmt.Sprintf(analysis, "")
+	fmt.Println(analysisChanged(context.Background(), client, "devicetype_v1", mapping["settings"]))
+
+	//Output:
+	//false <nil>
+	//true <nil>
+}
+
+func Example_deleteRemovedEntries() {
+	typeless := elasticTypeless
+	defer func() { elasticTypeless = typeless }()
+	elasticTypeless = true
+	client, stop, err := newFakeElasticClient(func(req *http.Request, body string) (int, string) {
+		switch {
+		case req.URL.Path == "/devicetype_v1/_search":
+			return http.StatusOK, `{"_scroll_id": "s1", "hits": {"total": 1, "hits": [{"_index": "devicetype_v1", "_id": "a", "_version": 2, "_seq_no": 7, "_primary_term": 1}]}}`
+		case req.URL.Path == "/_search/scroll" && req.Method != "DELETE":
+			return http.StatusOK, `{"_scroll_id": "s1", "hits": {"total": 1, "hits": []}}`
+		case req.URL.Path == "/devicetype_v2/_bulk":
+			lines := strings.Split(strings.TrimSpace(body), "\n")
+			sort.Strings(lines)
+			fmt.Println(req.URL.Path, lines)
+			return http.StatusOK, `{"errors": true, "items": [
+				{"delete": {"_id": "b", "status": 200, "result": "deleted"}},
+				{"delete": {"_id": "c", "status": 409, "error": {"reason": "version conflict"}}},
+				{"delete": {"_id": "d", "status": 404, "result": "not_found"}}]}`
+		}
+		return http.StatusOK, `{}`
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer stop()
+
+	//a still exists in the old index; c has been written to the new index again since it has been copied
+	copied := map[string]Version{"a": {Number: 3, PrimaryTerm: 1}, "b": {Number: 4, PrimaryTerm: 1}, "c": {Number: 5, PrimaryTerm: 1}, "d": {Number: 6, PrimaryTerm: 1}}
+	fmt.Println(deleteRemovedEntries(context.Background(), client, "devicetype_v1", "devicetype_v2", copied))
+
+	//Output:
+	///devicetype_v2/_bulk [{"delete":{"_id":"b","if_seq_no":4,"if_primary_term":1}} {"delete":{"_id":"c","if_seq_no":5,"if_primary_term":1}} {"delete":{"_id":"d","if_seq_no":6,"if_primary_term":1}}]
+	//1 <nil>
+}
+
+func Example_reindex() {
+	client, stop, err := newFakeElasticClient(func(req *http.Request, body string) (int, string) {
+		switch req.URL.Path {
+		case "/_reindex":
+			return http.StatusOK, `{"task": "node1:42"}`
+		case "/_tasks/node1:42/_cancel":
+			fmt.Println(req.Method, req.URL.Path)
+			return http.StatusOK, `{"nodes": {}}`
+		}
+		return http.StatusOK, `{"completed": false}`
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	fmt.Println(reindex(ctx, client, "devicetype_v1", "devicetype_v2", false, false))
+
+	//Output:
+	//POST /_tasks/node1:42/_cancel
+	//reindex devicetype_v1 -> devicetype_v2 aborted: context deadline exceeded
+}
+
+func Example_migrateMapping() {
+	initDb()
+	typeless := elasticTypeless
+	interval := reindexPollInterval
+	defer func() {
+		elasticTypeless = typeless
+		reindexPollInterval = interval
+	}()
+	elasticTypeless = false
+	reindexPollInterval = time.Millisecond
+	failAlias := false
+	client, stop, err := newFakeElasticClient(func(req *http.Request, body string) (int, string) {
+		switch {
+		case strings.HasPrefix(req.URL.Path, "/devicetype/_mapping"):
+			return http.StatusOK, `{"devicetype_v1": {"mappings": {}}}`
+		case req.URL.Path == "/devicetype_v2" && req.Method == "PUT":
+			fmt.Println(req.Method, req.URL.Path)
+			return http.StatusOK, `{"acknowledged": true}`
+		case req.URL.Path == "/_reindex":
+			fmt.Println(req.Method, req.URL.Path, strings.Contains(body, `"conflicts":"proceed"`))
+			return http.StatusOK, `{"task": "node1:42"}`
+		case strings.HasPrefix(req.URL.Path, "/_tasks/"):
+			return http.StatusOK, `{"completed": true}`
+		case strings.HasSuffix(req.URL.Path, "/_search") || req.URL.Path == "/_search/scroll":
+			return http.StatusOK, `{"_scroll_id": "s1", "hits": {"total": 0, "hits": []}}`
+		case req.URL.Path == "/devicetype_v1/_settings":
+			fmt.Println(req.Method, req.URL.Path, body)
+			return http.StatusOK, `{"acknowledged": true}`
+		case req.URL.Path == "/_aliases":
+			fmt.Println(req.Method, req.URL.Path)
+			if failAlias {
+				return http.StatusInternalServerError, `{"error": {"type": "exception", "reason": "alias failed"}, "status": 500}`
+			}
+			return http.StatusOK, `{"acknowledged": true}`
+		}
+		return http.StatusOK, `{}`
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer stop()
+
+	//the catch-up reindex runs while the old index is read-only
+	fmt.Println(migrateMapping(context.Background(), client, "devicetype"))
+
+	//a failed migration makes the old index writable again
+	failAlias = true
+	_, err = migrateMapping(context.Background(), client, "devicetype")
+	fmt.Println(err != nil)
+
+	//Output:
+	//PUT /devicetype_v2
+	//POST /_reindex false
+	//PUT /devicetype_v1/_settings {"index.blocks.write":true}
+	//POST /_reindex true
+	//POST /_aliases
+	//true <nil>
+	//PUT /devicetype_v2
+	//POST /_reindex false
+	//PUT /devicetype_v1/_settings {"index.blocks.write":true}
+	//POST /_reindex true
+	//POST /_aliases
+	//PUT /devicetype_v1/_settings {"index.blocks.write":false}
+	//true
+}
+
+func ExampleUpdateInitialGroupRights() {
+	initDb()
+	resourceConfig := Config.Resources["devicetype"]
+	resourceConfig.InitialGroupRights = map[string]string{"admin": "rwxa", "tester": "rx"}
+	Config.Resources["devicetype"] = resourceConfig
+
+	changed, err := UpdateInitialGroupRights()
+	fmt.Println(err, changed["devicetype"], changed["deviceinstance"])
+	fmt.Println(CheckGroups("devicetype", "foo1", []string{"tester"}, "rx"), CheckGroups("devicetype", "foo1", []string{"tester"}, "w"))
+
+	changed, err = UpdateInitialGroupRights()
+	fmt.Println(err, changed["devicetype"])
+
+	//Output:
+	//<nil> 4 0
+	//<nil> access denied
+	//<nil> 0
+}
+
+func ExampleReconcileInitialGroupRights() {
+	initDb()
+	SetGroupRight("devicetype", "foo2", "admin", "rw")
+
+	//without previous state only additions are possible
+	report, err := ReconcileInitialGroupRights(false)
+	fmt.Println(err, report["devicetype"].Affected, report["devicetype"].Add, report["devicetype"].Remove)
+
+	resourceConfig := Config.Resources["devicetype"]
+	resourceConfig.InitialGroupRights = map[string]string{"admin": "rx", "tester": "r"}
+	Config.Resources["devicetype"] = resourceConfig
+
+	report, err = ReconcileInitialGroupRights(true)
+	fmt.Println(err, report["devicetype"].Affected, report["devicetype"].Add, report["devicetype"].Remove)
+	fmt.Println(CheckGroups("devicetype", "foo1", []string{"admin"}, "w"))
+
+	report, err = ReconcileInitialGroupRights(false)
+	fmt.Println(err, report["devicetype"].Affected, report["deviceinstance"].Affected)
+	fmt.Println(CheckGroups("devicetype", "foo1", []string{"admin"}, "w"), CheckGroups("devicetype", "foo1", []string{"admin"}, "rx"), CheckGroups("devicetype", "foo1", []string{"tester"}, "r"))
+	fmt.Println(CheckGroups("devicetype", "foo2", []string{"admin"}, "r"))
+
+	report, err = ReconcileInitialGroupRights(true)
+	fmt.Println(err, report["devicetype"].Affected)
+
+	//Output:
+	//<nil> 1 map[admin:arwx user:rx] map[]
+	//<nil> 4 map[tester:r] map[admin:aw user:rx]
+	//<nil>
+	//<nil> 4 0
+	//access denied <nil> <nil>
+	//<nil>
+	//<nil> 0
+}
+
+func Example_loadInitialGroupRightsState() {
+	initDb()
+
+	//without stored state nothing has been applied before
+	previous, err := loadInitialGroupRightsState()
+	fmt.Println(err, previous)
+	fmt.Println(saveInitialGroupRightsState())
+	previous, err = loadInitialGroupRightsState()
+	fmt.Println(err, previous["devicetype"])
+
+	//Output:
+	//<nil> map[]
+	//<nil>
+	//<nil> map[admin:rwxa user:rx]
+}
+
+func ExampleUpdateInitialGroupRights_notification() {
+	initDb()
+	transport := NewChannelTransport()
+	SetTransport(transport)
+	defer func() {
+		transport.Close()
+		SetTransport(nil)
+	}()
+	events := []ChangeEvent{}
+	transport.Subscribe("test", Config.NotificationTopic, func(msg []byte) error {
+		event := ChangeEvent{}
+		err := json.Unmarshal(msg, &event)
+		events = append(events, event)
+		return err
+	})
+	SetGroupRight("devicetype", "foo2", "tester", "r")
+	transport.Wait()
+	events = []ChangeEvent{}
+
+	resourceConfig := Config.Resources["devicetype"]
+	resourceConfig.InitialGroupRights = map[string]string{"admin": "rwxa", "tester": "r"}
+	Config.Resources["devicetype"] = resourceConfig
+	changed, err := UpdateInitialGroupRights()
+	fmt.Println(err, changed["devicetype"])
+
+	resourceConfig.InitialGroupRights = map[string]string{"admin": "rwxa"}
+	Config.Resources["devicetype"] = resourceConfig
+	report, err := ReconcileInitialGroupRights(false)
+	fmt.Println(err, report["devicetype"].Affected)
+	transport.Wait()
+
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Rights[0].After != events[j].Rights[0].After {
+			return events[i].Rights[0].After > events[j].Rights[0].After
+		}
+		return events[i].Resource < events[j].Resource
+	})
+	for _, event := range events {
+		fmt.Print(event.Type, " ", event.Kind, " ", event.Resource)
+		for _, change := range event.Rights {
+			fmt.Print(" ", change.User, change.Group, "=", change.Before, ">", change.After)
+		}
+		fmt.Println()
+	}
+
+	//Output:
+	//<nil> 3
+	//<nil> 4
+	//rights devicetype foo1 tester=>r
+	//rights devicetype test tester=>r
+	//rights devicetype zway tester=>r
+	//rights devicetype foo1 tester=r>
+	//rights devicetype foo2 tester=r>
+	//rights devicetype test tester=r>
+	//rights devicetype zway tester=r>
+}
+
+func Example_messageKey() {
+	fmt.Printf("%q\n", messageKey([]byte(`{"command": "PUT", "Kind": "devicetype", "Resource": "r1", "User": "u1", "Right": "rx"}`)))
+	fmt.Printf("%q\n", messageKey([]byte(`{"command": "PUT", "id": "r2", "owner": "u1"}`)))
+	fmt.Printf("%q\n", messageKey([]byte(`{"type": "rights", "kind": "devicetype", "resource": "r3", "rights": []}`)))
+	fmt.Printf("%q\n", messageKey([]byte(`{"command": "PUT"}`)))
+	fmt.Printf("%q\n", messageKey([]byte(`flaky message`)))
+
+	//Output:
+	//"r1"
+	//"r2"
+	//"r3"
+	//""
+	//""
+}
+
+func ExampleListPage() {
+	initDb()
+	query := SearchQuery{Rights: "r", User: "testOwner", Limit: 2, Sort: []SortKey{{Feature: "name", Direction: "desc"}}}
+	cursor := ""
+	for {
+		page, err := ListPage("devicetype", query, cursor)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		for _, item := range page.Items {
+			fmt.Print(item["id"], " ", item["name"], "; ")
+		}
+		fmt.Println(page.Next != "")
+		if page.Next == "" {
+			break
+		}
+		cursor = page.Next
+	}
+	_, err := ListPage("devicetype", query, "foo")
+	fmt.Println(err)
+	next, _ := encodeCursor([]interface{}{"foo"})
+	_, err = ListPage("devicetype", query, next)
+	fmt.Println(err)
+
+	//Output:
+	//test test; foo2 foo2; true
+	//foo1 foo1; zway ZWay-SwitchMultilevel; true
+	//false
+	//invalid cursor
+	//invalid cursor
+}
+
+func Example_decodeCursor() {
+	initDb()
+	typeless := elasticTypeless
+	defer func() { elasticTypeless = typeless }()
+	elasticTypeless = true
+	client, stop, err := newFakeElasticClient(func(req *http.Request, body string) (int, string) {
+		request := map[string]json.RawMessage{}
+		json.Unmarshal([]byte(body), &request)
+		fmt.Println(string(request["search_after"]))
+		return http.StatusOK, `{"hits": {"total": 1, "hits": [{"_index": "devicetype_v1", "_id": "b", "_source": {"resource": "b"}, "sort": [9007199254740995, "b"]}]}}`
+	})
 	if err != nil {
-		panic(err)
+		fmt.Println(err)
+		return
+	}
+	defer stop()
+
+	//long sort values above 2^53 keep their precision from the hit to the next search_after
+	cursor, _ := encodeCursor([]interface{}{json.Number("9007199254740993"), "a"})
+	after, err := decodeCursor(cursor, 2)
+	fmt.Println(after, err)
+	result, err := NewElasticStorage(client).Search(context.Background(), "devicetype", SearchQuery{After: after})
+	fmt.Println(result.Next, err)
+	_, err = decodeCursor(cursor, 3)
+	fmt.Println(err)
+
+	//Output:
+	//[9007199254740993 a] <nil>
+	//[9007199254740993,"a"]
+	//[9007199254740995 b] <nil>
+	//invalid cursor
+}
+
+func Example_respondQuery() {
+	initDb()
+	jwt := jwt_http_router.Jwt{UserId: "testOwner"}
+	request := QueryRequest{Rights: "r", Sort: []SortKey{{Feature: "name"}}}
+	for _, target := range []string{"/list?envelope=true", "/list"} {
+		req := httptest.NewRequest("GET", target, nil)
+		res := httptest.NewRecorder()
+		respondQuery(res, req, "devicetype", jwt, request, "2", "1")
+		page := FeaturePage{}
+		json.Unmarshal(res.Body.Bytes(), &page)
+		fmt.Println(res.Code, page.Total, page.Limit, page.Offset, len(page.Items), page.Next == res.Header().Get("X-Next-Cursor"))
+	}
+
+	req := httptest.NewRequest("GET", "/list", nil)
+	req.Header.Set("Accept", PageMediaType)
+	res := httptest.NewRecorder()
+	respondQuery(res, req, "devicetype", jwt_http_router.Jwt{UserId: "nobody"}, QueryRequest{Rights: "r"}, "2", "0")
+	fmt.Println(res.Code, strings.TrimSpace(res.Body.String()))
+
+	res = httptest.NewRecorder()
+	respondQuery(res, httptest.NewRequest("GET", "/list?cursor=foo", nil), "devicetype", jwt, request, "2", "0")
+	fmt.Println(res.Code, strings.TrimSpace(res.Body.String()))
+
+	res = httptest.NewRecorder()
+	respondQuery(res, httptest.NewRequest("GET", "/list", nil), "devicetype", jwt, QueryRequest{Rights: "q"}, "2", "0")
+	fmt.Println(res.Code, strings.TrimSpace(res.Body.String()))
+
+	//Output:
+	//200 4 2 1 2 true
+	//200 0 0 0 0 false
+	//200 {"items":[],"total":0,"limit":2,"offset":0,"next":""}
+	//400 invalid cursor
+	//400 unknown right q
+}
+
+func ExampleQuery() {
+	initDb()
+	ImportResource("devicetype", ResourceRights{
+		ResourceId:  "slash",
+		Features:    map[string]interface{}{"name": "a/b device", "description": "with slash"},
+		UserRights:  map[string]Right{"testOwner": {Read: true}},
+		GroupRights: map[string]Right{},
+	})
+	request := QueryRequest{Text: "a/b", Fields: []string{"name"}}
+	fmt.Println(request.Validate("devicetype"))
+	page, err := Query("devicetype", "testOwner", []string{}, request)
+	fmt.Println(err, page.Total, len(page.Items))
+	for _, item := range page.Items {
+		fmt.Println(item["id"], item["name"], item["description"], item["creator"] != nil, item["permissions"] != nil)
+	}
+
+	request = QueryRequest{
+		Selection: &Selection{Condition: ConditionConfig{Feature: "features.vendor", Operation: QueryEqualOperation, Value: "foo1Vendor"}},
+		Sort:      []SortKey{{Feature: "name", Direction: "desc"}},
+	}
+	list, err := QueryAll("devicetype", "testOwner", []string{}, request)
+	fmt.Println(err, len(list))
+
+	fmt.Println(QueryRequest{}.Validate("unknown"))
+	fmt.Println(QueryRequest{Sort: []SortKey{{Feature: "name", Direction: "up"}}}.Validate("devicetype"))
+	fmt.Println(QueryRequest{Limit: -1}.Validate("devicetype"))
+
+	//Output:
+	//<nil>
+	//<nil> 1 1
+	//slash a/b device <nil> true true
+	//<nil> 1
+	//unknown resource kind unknown
+	//unknown sort direction up
+	//limit and offset must not be negative
+}
+
+func ExampleSortKey() {
+	initDb()
+	Config.ElasticMapping["gateway"]["name"] = map[string]interface{}{"type": "keyword", "copy_to": "feature_search", "lowercase_sort": true}
+	for i, name := range []string{"Zebra", "apple", "Mango", "apple"} {
+		ImportResource("gateway", ResourceRights{
+			ResourceId:  "gw" + strconv.Itoa(i),
+			Features:    map[string]interface{}{"name": name, "devices": strconv.Itoa(i % 2)},
+			UserRights:  map[string]Right{"testOwner": {Read: true}},
+			GroupRights: map[string]Right{},
+		})
+	}
+	print := func(sort ...SortKey) {
+		list, err := QueryAll("gateway", "testOwner", []string{}, QueryRequest{Sort: sort})
+		for _, item := range list {
+			fmt.Print(item["id"], "=", item["name"], " ")
+		}
+		fmt.Println(err)
+	}
+	print(SortKey{Feature: "name"})
+	print(SortKey{Feature: "devices", Direction: "desc"}, SortKey{Feature: "name"})
+	print(SortKey{Feature: "id", Direction: "desc"})
+	print(SortKey{Feature: "creator"}, SortKey{Feature: "name", Direction: "desc"})
+
+	mapping, _ := createMapping("gateway")
+	name := mapping["mappings"].(map[string]interface{})[ElasticPermissionType].(map[string]interface{})["properties"].(map[string]interface{})["features"].(map[string]interface{})["properties"].(map[string]interface{})["name"]
+	fmt.Println(name)
+
+	//Output:
+	//gw1=apple gw3=apple gw2=Mango gw0=Zebra <nil>
+	//gw1=apple gw3=apple gw2=Mango gw0=Zebra <nil>
+	//gw3=apple gw2=Mango gw1=apple gw0=Zebra <nil>
+	//gw0=Zebra gw2=Mango gw1=apple gw3=apple <nil>
+	//map[copy_to:feature_search fields:map[lowercase:map[normalizer:lowercase_normalizer type:keyword]] type:keyword]
+}
+
+func ExampleSuggest() {
+	initDb()
+	ImportResource("devicetype", ResourceRights{
+		ResourceId:  "hidden",
+		Features:    map[string]interface{}{"name": "zwave hidden"},
+		UserRights:  map[string]Right{"otherUser": {Read: true}},
+		GroupRights: map[string]Right{},
+	})
+	result, err := Suggest("devicetype", "testOwner", []string{}, "r", "zw", 5)
+	fmt.Println(err, result)
+	result, err = Suggest("devicetype", "testOwner", []string{}, "r", "foo1 vend", 5)
+	fmt.Println(err, result)
+	result, err = Suggest("devicetype", "otherUser", []string{}, "r", "ZWAVE", 0)
+	fmt.Println(err, result)
+	result, err = Suggest("devicetype", "testOwner", []string{}, "r", " ", 5)
+	fmt.Println(err, result)
+	_, err = Suggest("devicetype", "testOwner", []string{}, "r", "zw", 1000)
+	fmt.Println(err)
+	_, err = Suggest("devicetype", "testOwner", []string{}, "z", "zw", 5)
+	fmt.Println(err)
+	_, err = Suggest("devicetype", "testOwner", []string{}, "", "zw", 5)
+	fmt.Println(err)
+
+	//Output:
+	//<nil> [{zway name ZWay-SwitchMultilevel}]
+	//<nil> [{foo1 description foo1Desc} {zway vendor vendor}]
+	//<nil> [{hidden name zwave hidden}]
+	//<nil> []
+	//size has to be between 0 and 100
+	//unknown right z
+	//missing rights
+}
+
+func ExampleSearchKinds() {
+	initDb()
+	ImportResource("gateway", ResourceRights{
+		ResourceId:  "gw",
+		Features:    map[string]interface{}{"name": "zway gateway"},
+		UserRights:  map[string]Right{"testOwner": {Read: true}},
+		GroupRights: map[string]Right{},
+	})
+	ImportResource("processmodel", ResourceRights{
+		ResourceId:  "pm",
+		Features:    map[string]interface{}{"name": "zway process"},
+		UserRights:  map[string]Right{"otherUser": {Read: true}},
+		GroupRights: map[string]Right{},
+	})
+	page, err := SearchKinds("testOwner", []string{}, KindSearchRequest{Text: "zway gateway"})
+	fmt.Println(err, page.Total, page.Limit)
+	for _, hit := range page.Items {
+		fmt.Println(hit.Kind, hit.Score, hit.Item["id"], hit.Item["name"])
+	}
+	page, err = SearchKinds("otherUser", []string{}, KindSearchRequest{Text: "zway", Kinds: []string{"processmodel", "devicetype"}, Fields: []string{"description"}})
+	fmt.Println(err, page.Total, page.Items[0].Kind, page.Items[0].Item["name"])
+
+	fmt.Println(KindSearchRequest{Text: "zway", Kinds: []string{"unknown"}}.Validate())
+	fmt.Println(KindSearchRequest{}.Validate())
+
+	//Output:
+	//<nil> 2 10
+	//gateway 2 gw zway gateway
+	//devicetype 1 zway ZWay-SwitchMultilevel
+	//<nil> 1 processmodel <nil>
+	//unknown resource kind unknown
+	//missing text
+}
+
+func ExampleTextOptions() {
+	initDb()
+	ImportResource("devicetype", ResourceRights{
+		ResourceId:  "lamp",
+		Features:    map[string]interface{}{"name": "Kitchen Lamp", "description": "dimmable lamp for the kitchen"},
+		UserRights:  map[string]Right{"testOwner": {Read: true}},
+		GroupRights: map[string]Right{},
+	})
+	print := func(text string, options TextOptions) {
+		page, err := Query("devicetype", "testOwner", []string{}, QueryRequest{Text: text, TextOptions: options})
+		fmt.Print(err, " ", page.Total)
+		for _, item := range page.Items {
+			fmt.Print(" ", item["id"])
+			if highlight, ok := item["highlight"]; ok {
+				fmt.Print(" ", highlight)
+			}
+		}
+		fmt.Println()
+	}
+	print("kitchn", TextOptions{})
+	print("kitchn", TextOptions{Fuzziness: FuzzinessAuto})
+	print("kitchn", TextOptions{Fuzziness: "1", Highlight: true})
+	print("lamp kitchen", TextOptions{})
+	print("lamp kitchen", TextOptions{Mode: TextPhraseMode})
+	print("kitchen la", TextOptions{Mode: TextPrefixMode, Highlight: true})
+
+	//features left out by the projection are highlighted too
+	page, err := Query("devicetype", "testOwner", []string{}, QueryRequest{Text: "kitchen", TextOptions: TextOptions{Highlight: true}, Fields: []string{"name"}})
+	fmt.Println(err, page.Items[0]["description"], page.Items[0]["highlight"])
+
+	fmt.Println(TextOptions{Fuzziness: "3"}.Validate())
+	fmt.Println(TextOptions{Mode: TextPhraseMode, Fuzziness: "1"}.Validate())
+	fmt.Println(TextOptions{Mode: "regex"}.Validate())
+
+	//Output:
+	//<nil> 0
+	//<nil> 1 lamp
+	//<nil> 1 lamp map[description:[dimmable lamp for the <em>kitchen</em>] name:[<em>Kitchen</em> Lamp]]
+	//<nil> 1 lamp
+	//<nil> 0
+	//<nil> 1 lamp map[description:[dimmable <em>lamp</em> for the <em>kitchen</em>] name:[<em>Kitchen</em> <em>Lamp</em>]]
+	//<nil> <nil> map[description:[dimmable lamp for the <em>kitchen</em>] name:[<em>Kitchen</em> Lamp]]
+	//fuzziness has to be AUTO, 0, 1 or 2
+	//fuzziness is only supported in mode match
+	//unknown text mode regex
+}
+
+func ExampleParseQueryString() {
+	initDb()
+	selection, err := ParseQueryString("devicetype", `vendor:"foo1Vendor" AND NOT maintenance:broken`)
+	fmt.Println(err, len(selection.And), selection.And[0].Condition, selection.And[1].Not.Condition)
+
+	print := func(query string) {
+		selection, err := ParseQueryString("devicetype", query)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		list, err := QueryAll("devicetype", "testOwner", []string{}, QueryRequest{Selection: &selection, Sort: []SortKey{{Feature: "id"}}})
+		fmt.Print(err)
+		for _, item := range list {
+			fmt.Print(" ", item["id"])
+		}
+		fmt.Println()
+	}
+	print(`vendor:(foo1Vendor OR foo2Vendor) AND NOT name:foo2`)
+	print(`name:foo* OR (maintenance:"something" AND service:(serviceTest1 AND serviceTest3))`)
+	print(`NOT service:* OR vendor:vendor`)
+	print(`vendor:foo1Vendor name:foo1`)
+	print(`vendor:(foo1Vendor OR`)
+	print(`vendor:"foo1Vendor`)
+	print(`tag:lamp`)
+	print(`name foo1`)
+	print(`description:foo*`)
+
+	request, err := queryRequestFromUrl("devicetype", url.Values{"q": {"name:foo*"}, "sort": {"-name,id"}, "limit": {"5"}})
+	fmt.Println(err, request.Selection.Condition, request.Sort, request.Limit)
+
+	//Output:
+	//<nil> 2 {features.vendor == foo1Vendor } {features.maintenance == broken }
+	//<nil> foo1
+	//<nil> foo1 foo2 test
+	//<nil> zway
+	//position 19: expected AND, OR or end of query but found 'name'
+	//position 22: expected value of vendor but found end of query
+	//position 8: unterminated quoted string
+	//position 1: unknown feature tag of devicetype
+	//position 6: expected ':' after feature name but found 'foo1'
+	//position 13: prefix is only supported for keyword features; features.description is text
+	//<nil> {features.name prefix foo } [{name desc} {id asc}] 5
+}
+
+func ExampleResourceConfig_searchFallbackFeature() {
+	initDb()
+	print := func(text string) {
+		page, err := Query("devicetype", "testOwner", []string{}, QueryRequest{Text: text, TextOptions: TextOptions{Highlight: true}})
+		fmt.Print(err, " ", page.Total)
+		for _, item := range page.Items {
+			fmt.Print(" ", item["id"], " ", item["highlight"])
+		}
+		fmt.Println()
+	}
+	print("serviceTest1")
+	resource := Config.Resources["devicetype"]
+	resource.SearchFallbackFeature = "service"
+	Config.Resources["devicetype"] = resource
+	print("serviceTest1")
+	print("foo1")
+
+	Config.ElasticMapping["devicetype"] = map[string]interface{}{"service": map[string]interface{}{"type": "keyword"}}
+	print("foo2Serv")
+
+	resource.SearchFallbackFeature = "unknown"
+	Config.Resources["devicetype"] = resource
+	fmt.Println(validateConfig(Config))
+
+	//Output:
+	//<nil> 0
+	//<nil> 1 test map[service:[<em>serviceTest1</em>]]
+	//<nil> 1 foo1 map[description:[<em>foo1Desc</em>] name:[<em>foo1</em>] vendor:[<em>foo1Vendor</em>]]
+	//<nil> 1 foo2 map[service:[<em>foo2Service</em>]]
+	//SearchFallbackFeature unknown of devicetype is not in its Features
+}
+
+func ExampleStreamQuery() {
+	initDb()
+	jwt := jwt_http_router.Jwt{UserId: "testOwner"}
+	req := httptest.NewRequest("GET", "/jwt/list/devicetype/r", nil)
+	req.Header.Set("Accept", NdjsonMediaType)
+	res := httptest.NewRecorder()
+	respondQueryAll(res, req, "devicetype", jwt, QueryRequest{Rights: "r", Fields: []string{"name"}})
+	lines := strings.Split(strings.TrimSpace(res.Body.String()), "\n")
+	item := map[string]interface{}{}
+	json.Unmarshal([]byte(lines[0]), &item)
+	fmt.Println(res.Code, res.Header().Get("Content-Type"), len(lines), len(item))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	count := 0
+	err := StreamQuery(ctx, "devicetype", "testOwner", []string{}, QueryRequest{Rights: "r"}, func(item map[string]interface{}) error {
+		count++
+		cancel()
+		return nil
+	})
+	fmt.Println(err, count)
+
+	count = 0
+	err = StreamExport(context.Background(), func(line ExportLine) error {
+		count++
+		return nil
+	})
+	fmt.Println(err, count)
+
+	//Output:
+	//200 application/x-ndjson 4 4
+	//context canceled 1
+	//<nil> 4
+}
+
+func ExampleQueryRequest_projection() {
+	initDb()
+	ImportResource("processmodel", ResourceRights{
+		ResourceId:  "pm",
+		Features:    map[string]interface{}{"name": "pm", "svgXML": "<svg/>", "description": map[string]interface{}{"short": "s", "long": "l"}},
+		UserRights:  map[string]Right{"testOwner": {Read: true}},
+		GroupRights: map[string]Right{},
+	})
+	print := func(request QueryRequest) {
+		page, err := Query("processmodel", "testOwner", []string{}, request)
+		if err != nil || len(page.Items) != 1 {
+			fmt.Println(err, len(page.Items))
+			return
+		}
+		item := page.Items[0]
+		fmt.Println(item["id"], item["name"], item["svgXML"], item["description"], item["creator"] != nil, item["permissions"] != nil)
+	}
+
+	print(QueryRequest{})
+	print(QueryRequest{Fields: []string{"name", "description.short"}})
+	print(QueryRequest{ExcludeFields: []string{"svgXML", "description.long"}})
+
+	resource := Config.Resources["processmodel"]
+	resource.DefaultProjection = &Projection{Excludes: []string{"svgXML"}}
+	Config.Resources["processmodel"] = resource
+	print(QueryRequest{})
+	print(QueryRequest{Fields: []string{"*"}})
+
+	fmt.Println(QueryRequest{Fields: []string{""}}.Validate("processmodel"))
+
+	//Output:
+	//pm pm <svg/> map[long:l short:s] true true
+	//pm pm <nil> map[short:s] true true
+	//pm pm <nil> map[short:s] true true
+	//pm pm <nil> map[long:l short:s] true true
+	//pm pm <svg/> map[long:l short:s] true true
+	//empty field in projection
+}
+
+func ExampleGetFacets() {
+	initDb()
+	for i, date := range []string{"2019-01-05T10:00:00Z", "2019-01-20T10:00:00Z", "2019-03-01T00:00:00Z"} {
+		ImportResource("processmodel", ResourceRights{
+			ResourceId:  "pm" + strconv.Itoa(i),
+			Features:    map[string]interface{}{"name": "pm", "date": date, "publish": i > 0},
+			UserRights:  map[string]Right{"testOwner": {Read: true}},
+			GroupRights: map[string]Right{},
+		})
+	}
+	ImportResource("processmodel", ResourceRights{
+		ResourceId: "hidden",
+		Features:   map[string]interface{}{"name": "hidden", "date": "2019-01-01T00:00:00Z"},
+	})
+
+	request := FacetRequest{Features: []string{"date", "name"}}
+	fmt.Println(request.Validate("processmodel"))
+	result, err := GetFacets("processmodel", "testOwner", []string{}, "r", request)
+	fmt.Println(err, result["date"], result["name"])
+
+	request = FacetRequest{Features: []string{"date"}, Interval: "year", Selection: &Selection{Condition: ConditionConfig{Feature: "features.publish", Operation: QueryEqualOperation, Value: true}}}
+	result, err = GetFacets("processmodel", "testOwner", []string{}, "r", request)
+	fmt.Println(err, result["date"])
+
+	result, err = GetFacets("devicetype", "testOwner", []string{}, "r", FacetRequest{Features: []string{"maintenance"}, Size: 2})
+	fmt.Println(err, result["maintenance"])
+
+	fmt.Println(FacetRequest{Features: []string{"description"}}.Validate("devicetype"))
+	fmt.Println(FacetRequest{Features: []string{"unknown"}}.Validate("devicetype"))
+	fmt.Println(FacetRequest{Features: []string{"date"}, Interval: "decade"}.Validate("processmodel"))
+	_, err = GetFacets("processmodel", "testOwner", []string{}, "z", FacetRequest{Features: []string{"name"}})
+	fmt.Println(err)
+	_, err = GetFacets("processmodel", "testOwner", []string{}, "", FacetRequest{Features: []string{"name"}})
+	fmt.Println(err)
+
+	//Output:
+	//<nil>
+	//<nil> [{1.5463008e+12 2019-01-01T00:00:00.000Z 2} {1.5513984e+12 2019-03-01T00:00:00.000Z 1}] [{pm  3}]
+	//<nil> [{1.5463008e+12 2019-01-01T00:00:00.000Z 2}]
+	//<nil> [{different  1} {something  1}]
+	//unable to aggregate text or object feature description
+	//feature unknown is not in the ElasticMapping of devicetype
+	//unknown interval decade
+	//unknown right z
+	//missing rights
+}
+
+func ExampleConditionConfig_Validate() {
+	initDb()
+	for i, date := range []string{"2019-01-05T10:00:00Z", "2019-01-20T10:00:00Z", "2019-03-01T00:00:00Z"} {
+		ImportResource("processmodel", ResourceRights{
+			ResourceId: "pm" + strconv.Itoa(i),
+			Features:   map[string]interface{}{"name": "model_" + strconv.Itoa(i), "date": date},
+			UserRights: map[string]Right{"testOwner": {Read: true}},
+		})
+	}
+	conditions := []ConditionConfig{
+		{Feature: "features.date", Operation: QueryGreaterOperation, Value: "2019-01-05T10:00:00Z"},
+		{Feature: "features.date", Operation: QueryLessEqualOperation, Value: "2019-01-20T10:00:00Z"},
+		{Feature: "features.date", Operation: QueryBetweenOperation, Value: []interface{}{"2019-01-06", "2019-12-31"}},
+		{Feature: "features.name", Operation: QueryPrefixOperation, Value: "model_"},
+		{Feature: "features.name", Operation: QueryWildcardOperation, Value: "*_?"},
+		{Feature: "features.name", Operation: QueryRegexpOperation, Value: "model_[02]"},
+		{Feature: "features.publish", Operation: QueryNotExistsOperation},
+		{Feature: "features.publish", Operation: QueryExistsOperation},
+	}
+	for _, condition := range conditions {
+		list, err := GetOrderedListForUserOrGroupWithSelection("processmodel", "testOwner", []string{}, "r", "10", "0", "name", true, Selection{Condition: condition})
+		fmt.Print(condition.Validate("processmodel"), err, " ", condition.Operation)
+		for _, element := range list {
+			fmt.Print(" ", element["id"])
+		}
+		fmt.Println()
+	}
+
+	invalid := []ConditionConfig{
+		{Feature: "features.date", Operation: QueryLessOperation, Value: "yesterday"},
+		{Feature: "features.name", Operation: QueryGreaterOperation, Value: 42},
+		{Feature: "features.publish", Operation: QueryGreaterOperation, Value: true},
+		{Feature: "features.date", Operation: QueryBetweenOperation, Value: []interface{}{"2019-01-01"}},
+		{Feature: "features.date", Operation: QueryPrefixOperation, Value: "2019"},
+		{Feature: "features.name", Operation: QueryRegexpOperation, Value: "model_(0"},
+		{Feature: "features.unknown", Operation: QueryExistsOperation},
+		{Feature: "features.name", Operation: "~"},
+	}
+	for _, condition := range invalid {
+		fmt.Println(condition.Validate("processmodel"))
+	}
+
+	//Output:
+	//<nil> <nil> > pm1 pm2
+	//<nil> <nil> <= pm0 pm1
+	//<nil> <nil> between pm1 pm2
+	//<nil> <nil> prefix pm0 pm1 pm2
+	//<nil> <nil> wildcard pm0 pm1 pm2
+	//<nil> <nil> regexp pm0 pm2
+	//<nil> <nil> not_exists pm0 pm1 pm2
+	//<nil> <nil> exists
+	//expect date value for features.date
+	//expect string value for features.name
+	//range operations are not supported for features.publish of type boolean
+	//between on features.date expects a list of two values
+	//prefix is only supported for keyword features; features.date is date
+	//invalid regexp for features.name: error parsing regexp: missing closing ): `model_(0`
+	//feature features.unknown is not in the ElasticMapping of processmodel
+	//unknown query opperation type ~
+}
+
+func Example_validateRegexp() {
+	initDb()
+	for i, name := range []string{"model_0", "Model.1", "model_22", "model (3)"} {
+		ImportResource("processmodel", ResourceRights{
+			ResourceId: "re" + strconv.Itoa(i),
+			Features:   map[string]interface{}{"name": name},
+			UserRights: map[string]Right{"testOwner": {Read: true}},
+		})
+	}
+	//the same query is sent to elasticsearch and matched by the memory storage
+	valid := []string{"model_[0-2]+", "[mM]odel.1", "model_2{2}", "(model|Model)[._]?[^2]", "model \\(3\\)", "mo.*l_[0-9]{1,}", "()model_0"}
+	for _, pattern := range valid {
+		condition := ConditionConfig{Feature: "features.name", Operation: QueryRegexpOperation, Value: pattern}
+		query, _ := condition.GetFilter()
+		source, _ := query.Source()
+		list, err := GetOrderedListForUserOrGroupWithSelection("processmodel", "testOwner", []string{}, "r", "10", "0", "name", true, Selection{Condition: condition})
+		fmt.Print(condition.Validate("processmodel"), " ", err, " ", source)
+		for _, element := range list {
+			fmt.Print(" ", element["id"])
+		}
+		fmt.Println()
+	}
+
+	//go and lucene syntax outside of the common subset
+	invalid := []string{"^model_0$", "model_\\d", "(?i)model_0", "[[:alpha:]]+", "model|", "(|model)", "model{2", "model_0 #", "a~b", "model@", "\"model\"", "[]a]"}
+	for _, pattern := range invalid {
+		fmt.Println(pattern, validateRegexp(pattern))
+	}
+
+	//Output:
+	//<nil> <nil> map[regexp:map[features.name:map[value:model_[0-2]+]]] re0 re2
+	//<nil> <nil> map[regexp:map[features.name:map[value:[mM]odel.1]]] re1
+	//<nil> <nil> map[regexp:map[features.name:map[value:model_2{2}]]] re2
+	//<nil> <nil> map[regexp:map[features.name:map[value:(model|Model)[._]?[^2]]]] re1 re0
+	//<nil> <nil> map[regexp:map[features.name:map[value:model \(3\)]]] re3
+	//<nil> <nil> map[regexp:map[features.name:map[value:mo.*l_[0-9]{1,}]]] re0 re2
+	//<nil> <nil> map[regexp:map[features.name:map[value:()model_0]]] re0
+	//^model_0$ ^ has to be escaped
+	//model_\d only punctuation may be escaped with \
+	//(?i)model_0 missing expression before ?
+	//[[:alpha:]]+ [ has to be escaped in a character class
+	//model| empty alternative
+	//(|model) empty alternative
+	//model{2 { has to start a repetition like {2}, {2,} or {2,5}
+	//model_0 # # has to be escaped
+	//a~b ~ has to be escaped
+	//model@ @ has to be escaped
+	//"model" " has to be escaped
+	//[]a] empty character class
+}
+
+func ExampleSelection_nested() {
+	initDb()
+	Config.ElasticMapping["devicetype"]["services"] = map[string]interface{}{
+		"type": "nested",
+		"properties": map[string]interface{}{
+			"id":       map[string]interface{}{"type": "keyword"},
+			"protocol": map[string]interface{}{"type": "keyword"},
+		},
+	}
+	ImportResource("devicetype", ResourceRights{
+		ResourceId: "nested",
+		Features: map[string]interface{}{"name": "nested", "services": []interface{}{
+			map[string]interface{}{"id": "s1", "protocol": "mqtt"},
+			map[string]interface{}{"id": "s2", "protocol": "http"},
+		}},
+		UserRights: map[string]Right{"testOwner": {Read: true}},
+	})
+	query := func(selection Selection) {
+		list, err := GetOrderedListForUserOrGroupWithSelection("devicetype", "testOwner", []string{}, "r", "10", "0", "name", true, selection)
+		fmt.Print(selection.Validate("devicetype"), err)
+		for _, element := range list {
+			fmt.Print(" ", element["id"])
+		}
+		fmt.Println()
+	}
+	sameElement := []Selection{
+		{Condition: ConditionConfig{Feature: "features.services.id", Operation: QueryEqualOperation, Value: "s1"}},
+		{Condition: ConditionConfig{Feature: "features.services.protocol", Operation: QueryEqualOperation, Value: "http"}},
 	}
+	query(Selection{And: sameElement})
+	query(Selection{Nested: &NestedSelection{Path: "features.services", Selection: Selection{And: sameElement}}})
+	sameElement[1].Condition.Value = "mqtt"
+	query(Selection{Nested: &NestedSelection{Path: "features.services", Selection: Selection{And: sameElement}}})
+
+	query(Selection{Not: &Selection{Condition: ConditionConfig{Feature: "features.name", Operation: QueryPrefixOperation, Value: "foo"}}})
+	query(Selection{MinimumShouldMatch: 2, Or: []Selection{
+		{Condition: ConditionConfig{Feature: "features.name", Operation: QueryPrefixOperation, Value: "foo"}},
+		{Condition: ConditionConfig{Feature: "features.vendor", Operation: QueryEqualOperation, Value: "foo1Vendor"}},
+		{Condition: ConditionConfig{Feature: "features.maintenance", Operation: QueryExistsOperation}},
+	}})
+
+	fmt.Println(Selection{Nested: &NestedSelection{Path: "features.vendor", Selection: Selection{And: sameElement}}}.Validate("devicetype"))
+	fmt.Println(Selection{MinimumShouldMatch: 3, Or: sameElement}.Validate("devicetype"))
+
+	//Output:
+	//<nil> <nil> nested
+	//<nil> <nil>
+	//<nil> <nil> nested
+	//<nil> <nil> zway nested test
+	//<nil> <nil> foo1
+	//nested path features.vendor is not mapped as nested in the ElasticMapping of devicetype
+	//minimum_should_match has to be between 0 and the number of or elements
+}
+
+func ExampleConfigStruct_scrollBatchSize() {
+	initDb()
+	Config.ScrollBatchSize = 1
+	defer func() { Config.ScrollBatchSize = 0 }()
+	list, err := QueryAll("devicetype", "testOwner", []string{}, QueryRequest{Sort: []SortKey{{Feature: "id", Direction: "desc"}}})
+	for _, item := range list {
+		fmt.Print(item["id"], " ")
+	}
+	fmt.Println(err)
+	exported, err := ExportKindAll("devicetype")
+	fmt.Println(len(exported), err)
+
+	//Output:
+	//zway test foo2 foo1 <nil>
+	//4 <nil>
+}
+
+func ExampleChannelTransport() {
+	initDb()
+	transport := NewChannelTransport()
+	SetTransport(transport)
+	defer func() {
+		transport.Close()
+		SetTransport(nil)
+	}()
+	fmt.Println(InitEventHandling())
+	fmt.Println(transport.Subscribe(consumerGroup("gateway"), "gateway", nil))
+
+	fmt.Println(sendEvent("gateway", map[string]interface{}{"command": "PUT", "id": "gwEvent", "owner": "testOwner", "name": "event gateway"}))
+	transport.Wait()
+	fmt.Println(sendEvent(Config.PermTopic, PermCommandMsg{Command: "PUT", Kind: "gateway", Resource: "gwEvent", Group: "viewer", Right: "r"}))
+	transport.Wait()
+	entry, _, err := GetStorage().Get(context.Background(), "gateway", "gwEvent")
+	fmt.Println(err, entry.Features["name"], entry.Creator, entry.ReadGroups)
+
+	fmt.Println(sendEvent("gateway", CommandWrapper{Command: "DELETE", Id: "gwEvent"}))
+	transport.Wait()
+	fmt.Println(GetStorage().Exists(context.Background(), "gateway", "gwEvent"))
+
+	//Output:
+	//<nil>
+	//consumer group permsearch_gateway already subscribed to gateway
+	//<nil>
+	//<nil>
+	//<nil> event gateway testOwner [admin viewer]
+	//<nil>
+	//false <nil>
+}
+
+func ExampleChannelTransport_Close() {
+	transport := NewChannelTransport()
+
+	//a handler publishing to its own topic does not block on a full queue
+	count := 0
+	transport.Subscribe("group", "countdown", func(msg []byte) error {
+		count++
+		if count < 500 {
+			return transport.Publish("countdown", msg)
+		}
+		return nil
+	})
+	transport.Publish("countdown", []byte("tick"))
+	transport.Wait()
+	fmt.Println(count)
+
+	//messages which are not handled when the transport is closed are not awaited
+	blocked := make(chan struct{})
+	transport.Subscribe("group", "blocked", func(msg []byte) error {
+		<-blocked
+		return nil
+	})
+	for i := 0; i < 200; i++ {
+		transport.Publish("blocked", []byte("message"))
+	}
+	transport.Close()
+	transport.Wait()
+	close(blocked)
+	fmt.Println(transport.Publish("blocked", []byte("message")))
+
+	//Output:
+	//500
+	//transport closed
+}
+
+func ExampleReplayDeadLetter() {
+	initDb()
+	transport := NewChannelTransport()
+	SetTransport(transport)
+	defer func() {
+		transport.Close()
+		SetTransport(nil)
+	}()
+	Config.TopicEventRetry["flaky"] = 2
+	fmt.Println(InitEventHandling())
+
+	handled := []string{}
+	fixed := false
+	transport.Subscribe(consumerGroup("flaky"), "flaky", deadLetterHandler("flaky", func(msg []byte) error {
+		if !fixed {
+			return errors.New("not fixed")
+		}
+		handled = append(handled, string(msg))
+		return nil
+	}))
+
+	transport.Publish(Config.UserTopic, []byte(`{"command": "PUT"`))
+	transport.Wait()
+	transport.Publish(Config.UserTopic, []byte(`{"command": "PUT", "id": "u1"}`))
+	transport.Wait()
+	transport.Publish("flaky", []byte("flaky message"))
+	transport.Wait()
+
+	letters, err := ListDeadLetters(0, 0)
+	fmt.Println(err)
+	for _, letter := range letters {
+		fmt.Println(letter.Id != "", letter.Topic, letter.Payload, letter.Attempts, letter.Error)
+	}
+
+	fixed = true
+	fmt.Println(ReplayDeadLetter(letters[2].Id), ReplayDeadLetter(letters[2].Id))
+	transport.Wait()
+	fmt.Println(handled)
+	fmt.Println(DeleteDeadLetter(letters[0].Id), DeleteDeadLetter(letters[0].Id))
+	letters, err = ListDeadLetters(1, 0)
+	fmt.Println(len(letters), letters[0].Payload, err)
+	letters, err = ListDeadLetters(1, 1)
+	fmt.Println(len(letters), err)
+
+	//Output:
+	//<nil>
+	//<nil>
+	//true user {"command": "PUT" 1 unexpected end of JSON input
+	//true user {"command": "PUT", "id": "u1"} 1 unable to handle user command: {"command": "PUT", "id": "u1"}
+	//true flaky flaky message 2 not fixed
+	//<nil> not found
+	//[flaky message]
+	//<nil> not found
+	//1 {"command": "PUT", "id": "u1"} <nil>
+	//0 <nil>
+}
+
+func Example_requireAdmin() {
+	for _, roles := range [][]string{{"user"}, {"user", "admin"}} {
+		res := httptest.NewRecorder()
+		jwt := jwt_http_router.Jwt{UserId: "u1"}
+		jwt.RealmAccess.Roles = roles
+		fmt.Println(requireAdmin(res, jwt), res.Code)
+	}
+
+	//Output:
+	//false 403
+	//true 200
+}
+
+func Example_attemptCounter() {
+	counter := newAttemptCounter()
+	now := time.Now()
+	first, second := sha256.Sum256([]byte("first")), sha256.Sum256([]byte("second"))
+	fmt.Println(counter.increment(first, now), counter.increment(first, now), counter.increment(second, now))
+	counter.reset(first)
+	fmt.Println(counter.increment(first, now), len(counter.attempts))
+
+	//the second message was handled by another instance and is forgotten after attemptTTL
+	fmt.Println(counter.increment(first, now.Add(attemptTTL/2)), counter.increment(first, now.Add(attemptTTL+time.Minute)), len(counter.attempts))
+
+	for i := 0; i < maxTrackedMessages; i++ {
+		counter.increment(sha256.Sum256([]byte(strconv.Itoa(i))), now.Add(attemptTTL+time.Duration(i)))
+	}
+	fmt.Println(len(counter.attempts) <= maxTrackedMessages)
+
+	//Output:
+	//1 2 1
+	//1 2
+	//2 3 1
+	//true
+}
+
+func ExampleResourceConfig_versionPath() {
+	initDb()
+	gateway := Config.Resources["gateway"]
+	gateway.VersionPath = "$.version+"
+	Config.Resources["gateway"] = gateway
+	handler := getResourceCommandHandler("gateway")
+	print := func() {
+		entry, _, err := GetStorage().Get(context.Background(), "gateway", "gwVersion")
+		fmt.Println(err, entry.Features["name"], entry.EventVersion)
+	}
+
+	fmt.Println(handler([]byte(`{"command": "PUT", "id": "gwVersion", "owner": "testOwner", "name": "v2", "version": 2}`)))
+	print()
+	before := StaleEvents()["gateway"]
+	fmt.Println(handler([]byte(`{"command": "PUT", "id": "gwVersion", "owner": "testOwner", "name": "v1", "version": 1}`)))
+	print()
+	fmt.Println(handler([]byte(`{"command": "PUT", "id": "gwVersion", "owner": "testOwner", "name": "unversioned"}`)))
+	print()
+	fmt.Println(handler([]byte(`{"command": "PUT", "id": "gwVersion", "owner": "testOwner", "name": "v3", "version": "1970-01-01T00:00:00.000000003Z"}`)))
+	print()
+	fmt.Println(handler([]byte(`{"command": "DELETE", "id": "gwVersion", "version": 2}`)))
+	print()
+	fmt.Println(StaleEvents()["gateway"] - before)
+	fmt.Println(handler([]byte(`{"command": "PUT", "id": "gwVersion", "name": "broken", "version": "yesterday"}`)))
+	fmt.Println(handler([]byte(`{"command": "DELETE", "id": "gwVersion", "version": 3}`)))
+	fmt.Println(GetStorage().Exists(context.Background(), "gateway", "gwVersion"))
+
+	//versions above 2^53 keep their precision
+	fmt.Println(handler([]byte(`{"command": "PUT", "id": "gwVersion", "owner": "testOwner", "name": "big", "version": 9007199254740993}`)))
+	fmt.Println(handler([]byte(`{"command": "PUT", "id": "gwVersion", "owner": "testOwner", "name": "big2", "version": 9007199254740992}`)))
+	print()
+	fmt.Println(handler([]byte(`{"command": "PUT", "id": "gwVersion", "owner": "testOwner", "name": "float", "version": 9.1e15}`)))
+	print()
+	fmt.Println(handler([]byte(`{"command": "PUT", "id": "gwVersion", "owner": "testOwner", "name": "broken", "version": 1.5}`)))
+
+	//a delete keeps no version, so an older event after the delete creates the resource again
+	fmt.Println(handler([]byte(`{"command": "DELETE", "id": "gwVersion", "version": 9200000000000000}`)))
+	fmt.Println(handler([]byte(`{"command": "PUT", "id": "gwVersion", "owner": "testOwner", "name": "v1", "version": 1}`)))
+	print()
+
+	//Output:
+	//<nil>
+	//<nil> v2 2
+	//<nil>
+	//<nil> v2 2
+	//<nil>
+	//<nil> unversioned 2
+	//<nil>
+	//<nil> v3 3
+	//<nil>
+	//<nil> v3 3
+	//2
+	//version yesterday of gateway is neither an integer nor a RFC 3339 timestamp
+	//<nil>
+	//false <nil>
+	//<nil>
+	//<nil>
+	//<nil> big 9007199254740993
+	//<nil>
+	//<nil> float 9100000000000000
+	//version 1.5 of gateway is not an integer
+	//<nil>
+	//<nil>
+	//<nil> v1 1
+}
+
+// racingStorage runs race once before the next create or delete, like a concurrent event handled in between
+type racingStorage struct {
+	*MemoryStorage
+	race func()
+}
+
+func (this *racingStorage) runRace() {
+	if race := this.race; race != nil {
+		this.race = nil
+		race()
+	}
+}
+
+func (this *racingStorage) Create(ctx context.Context, kind string, entry Entry) error {
+	this.runRace()
+	return this.MemoryStorage.Create(ctx, kind, entry)
+}
+
+func (this *racingStorage) Delete(ctx context.Context, kind string, resource string, version Version) error {
+	this.runRace()
+	return this.MemoryStorage.Delete(ctx, kind, resource, version)
+}
+
+func ExampleResourceConfig_versionPathRace() {
+	initDb()
+	gateway := Config.Resources["gateway"]
+	gateway.VersionPath = "$.version+"
+	Config.Resources["gateway"] = gateway
+	storage := &racingStorage{MemoryStorage: GetStorage().(*MemoryStorage)}
+	SetStorage(storage)
+	handler := getResourceCommandHandler("gateway")
+	print := func() {
+		entry, _, err := GetStorage().Get(context.Background(), "gateway", "gwRace")
+		fmt.Println(err, entry.Features["name"], entry.EventVersion)
+	}
+
+	//a newer event creates the resource after the older one found it missing
+	storage.race = func() {
+		fmt.Println(handler([]byte(`{"command": "PUT", "id": "gwRace", "owner": "testOwner", "name": "v2", "version": 2}`)))
+	}
+	fmt.Println(handler([]byte(`{"command": "PUT", "id": "gwRace", "owner": "testOwner", "name": "v1", "version": 1}`)))
+	print()
+
+	//a newer event updates the resource after an older delete has read it
+	storage.race = func() {
+		fmt.Println(handler([]byte(`{"command": "PUT", "id": "gwRace", "owner": "testOwner", "name": "v4", "version": 4}`)))
+	}
+	fmt.Println(handler([]byte(`{"command": "DELETE", "id": "gwRace", "version": 3}`)))
+	print()
+
+	//Output:
+	//<nil>
+	//<nil>
+	//<nil> v2 2
+	//<nil>
+	//<nil>
+	//<nil> v4 4
+}
+
+func ExampleChangeEvent() {
+	initDb()
+	transport := NewChannelTransport()
+	SetTransport(transport)
+	defer func() {
+		transport.Close()
+		SetTransport(nil)
+	}()
+	events := []ChangeEvent{}
+	transport.Subscribe("test", Config.NotificationTopic, func(msg []byte) error {
+		event := ChangeEvent{}
+		err := json.Unmarshal(msg, &event)
+		events = append(events, event)
+		return err
+	})
+
+	fmt.Println(UpdateFeatures("gateway", []byte(`{"command": "PUT", "id": "gwNotify", "owner": "owner1", "name": "n1"}`), CommandWrapper{Command: "PUT", Id: "gwNotify", Owner: "owner1"}))
+	fmt.Println(UpdateFeatures("gateway", []byte(`{"command": "PUT", "id": "gwNotify", "name": "n2"}`), CommandWrapper{Command: "PUT", Id: "gwNotify"}))
+	fmt.Println(SetUserRight("gateway", "gwNotify", "user1", "rx"))
+	fmt.Println(SetUserRight("gateway", "gwNotify", "user1", "xr"))
+	fmt.Println(SetGroupRight("gateway", "gwNotify", "admin", "r"))
+	fmt.Println(DeleteUserRight("gateway", "gwNotify", "owner1"))
+	fmt.Println(DeleteUserRight("gateway", "gwNotify", "nobody"))
+	fmt.Println(DeleteGroupRight("gateway", "gwNotify", "admin"))
+	fmt.Println(DeleteGroupRight("gateway", "gwNotify", "admin"))
+	fmt.Println(DeleteFeatures("gateway", CommandWrapper{Command: "DELETE", Id: "gwNotify"}))
+	fmt.Println(DeleteFeatures("gateway", CommandWrapper{Command: "DELETE", Id: "gwNotify"}))
+	transport.Wait()
+
+	for _, event := range events {
+		fmt.Print(event.Type, " ", event.Kind, " ", event.Resource, " ", !event.Time.IsZero())
+		for _, change := range event.Rights {
+			fmt.Print(" ", change.User, change.Group, "=", change.Before, ">", change.After)
+		}
+		fmt.Println()
+	}
+
+	//Output:
+	//<nil>
+	//<nil>
+	//<nil>
+	//<nil>
+	//<nil>
+	//<nil>
+	//<nil>
+	//<nil>
+	//<nil>
+	//<nil>
+	//<nil>
+	//features gateway gwNotify true admin=>arwx owner1=>arwx
+	//features gateway gwNotify true
+	//rights gateway gwNotify true user1=>rx
+	//rights gateway gwNotify true admin=arwx>r
+	//rights gateway gwNotify true owner1=arwx>
+	//rights gateway gwNotify true admin=r>
+	//delete gateway gwNotify true user1=rx>
 }
@@ -0,0 +1,849 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const memoryMaxGram = 20
+
+// MemoryStorage keeps all entries in process and evaluates queries like the elasticsearch mapping would
+type MemoryStorage struct {
+	mux         sync.RWMutex
+	kinds       map[string]map[string]memoryEntry
+	deadLetters map[string]DeadLetter
+	state       map[string][]byte
+}
+
+type memoryEntry struct {
+	entry   Entry
+	version int64
+}
+
+type memoryHit struct {
+	kind    string
+	entry   Entry
+	version int64
+	doc     map[string]interface{}
+	score   int
+	sort    []interface{}
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{kinds: map[string]map[string]memoryEntry{}, deadLetters: map[string]DeadLetter{}, state: map[string][]byte{}}
+}
+
+func (this *MemoryStorage) Exists(ctx context.Context, kind string, resource string) (bool, error) {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	_, ok := this.kinds[kind][resource]
+	return ok, nil
+}
+
+func (this *MemoryStorage) Get(ctx context.Context, kind string, resource string) (entry Entry, version Version, err error) {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	element, ok := this.kinds[kind][resource]
+	if !ok {
+		return entry, version, ErrNotFound
+	}
+	entry, err = copyEntry(element.entry)
+	return entry, Version{Number: element.version}, err
+}
+
+func (this *MemoryStorage) Put(ctx context.Context, kind string, entry Entry, version Version) (err error) {
+	entry, err = copyEntry(entry)
+	if err != nil {
+		return err
+	}
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	if _, ok := this.kinds[kind]; !ok {
+		this.kinds[kind] = map[string]memoryEntry{}
+	}
+	current, exists := this.kinds[kind][entry.Resource]
+	if version.IsSet() && (!exists || current.version != version.Number) {
+		return ErrVersionConflict
+	}
+	this.kinds[kind][entry.Resource] = memoryEntry{entry: entry, version: current.version + 1}
+	return nil
+}
+
+func (this *MemoryStorage) Create(ctx context.Context, kind string, entry Entry) (err error) {
+	entry, err = copyEntry(entry)
+	if err != nil {
+		return err
+	}
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	if _, ok := this.kinds[kind]; !ok {
+		this.kinds[kind] = map[string]memoryEntry{}
+	}
+	if _, exists := this.kinds[kind][entry.Resource]; exists {
+		return ErrVersionConflict
+	}
+	this.kinds[kind][entry.Resource] = memoryEntry{entry: entry, version: 1}
+	return nil
+}
+
+func (this *MemoryStorage) Delete(ctx context.Context, kind string, resource string, version Version) error {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	current, ok := this.kinds[kind][resource]
+	if !ok {
+		return ErrNotFound
+	}
+	if version.IsSet() && current.version != version.Number {
+		return ErrVersionConflict
+	}
+	delete(this.kinds[kind], resource)
+	return nil
+}
+
+func (this *MemoryStorage) Search(ctx context.Context, kind string, query SearchQuery) (result SearchResult, err error) {
+	hits, err := this.find(kind, query)
+	if err != nil {
+		return result, err
+	}
+	keys := memorySort(kind, query, hits)
+	result.Total = int64(len(hits))
+	if query.After != nil {
+		after := []memoryHit{}
+		for _, hit := range hits {
+			if memoryCompareSortValues(hit.sort, query.After, keys) > 0 {
+				after = append(after, hit)
+			}
+		}
+		hits = after
+	}
+	result.Hits = []Entry{}
+	for _, hit := range memoryPage(hits, query.Limit, query.Offset) {
+		if query.Projection != nil {
+			hit.entry.Features = memoryProjectFeatures(hit.entry.Features, query.Projection.Includes, query.Projection.Excludes)
+		}
+		result.Hits = append(result.Hits, hit.entry)
+		result.Next = hit.sort
+	}
+	return
+}
+
+func (this *MemoryStorage) Export(ctx context.Context, kind string, limit int, offset int) (result []Entry, err error) {
+	hits, err := this.find(kind, SearchQuery{})
+	if err != nil {
+		return result, err
+	}
+	result = []Entry{}
+	for _, hit := range memoryPage(hits, limit, offset) {
+		result = append(result, hit.entry)
+	}
+	return
+}
+
+func (this *MemoryStorage) Scroll(ctx context.Context, kind string, query SearchQuery, batchSize int, handler func([]VersionedEntry) error) error {
+	hits, err := this.find(kind, query)
+	if err != nil {
+		return err
+	}
+	memorySort(kind, query, hits)
+	if batchSize <= 0 {
+		batchSize = defaultSearchSize
+	}
+	for start := 0; start < len(hits); start += batchSize {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		batch := []VersionedEntry{}
+		for _, hit := range memoryPage(hits, batchSize, start) {
+			if query.Projection != nil {
+				hit.entry.Features = memoryProjectFeatures(hit.entry.Features, query.Projection.Includes, query.Projection.Excludes)
+			}
+			batch = append(batch, VersionedEntry{Entry: hit.entry, Version: Version{Number: hit.version}})
+		}
+		if err = handler(batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *MemoryStorage) PutBulk(ctx context.Context, kind string, entries []VersionedEntry) (conflicts []string, err error) {
+	for _, element := range entries {
+		err = this.Put(ctx, kind, element.Entry, element.Version)
+		if err == ErrVersionConflict {
+			conflicts = append(conflicts, element.Entry.Resource)
+			continue
+		}
+		if err != nil {
+			return conflicts, err
+		}
+	}
+	return conflicts, nil
+}
+
+func (this *MemoryStorage) SearchKinds(ctx context.Context, kinds []string, query SearchQuery) (result KindSearchResult, err error) {
+	hits := []memoryHit{}
+	for _, kind := range kinds {
+		found, err := this.find(kind, query)
+		if err != nil {
+			return result, err
+		}
+		hits = append(hits, found...)
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		return hits[i].entry.Resource < hits[j].entry.Resource
+	})
+	result.Total = int64(len(hits))
+	result.Hits = []KindEntry{}
+	for _, hit := range memoryPage(hits, query.Limit, query.Offset) {
+		if query.Projection != nil {
+			hit.entry.Features = memoryProjectFeatures(hit.entry.Features, query.Projection.Includes, query.Projection.Excludes)
+		}
+		result.Hits = append(result.Hits, KindEntry{Kind: hit.kind, Score: float64(hit.score), Entry: hit.entry})
+	}
+	return
+}
+
+func (this *MemoryStorage) Facets(ctx context.Context, kind string, query SearchQuery, facets []Facet) (result map[string][]FacetBucket, err error) {
+	hits, err := this.find(kind, query)
+	if err != nil {
+		return result, err
+	}
+	result = map[string][]FacetBucket{}
+	for _, facet := range facets {
+		counts := map[string]*FacetBucket{}
+		for _, hit := range hits {
+			//like elasticsearch every document is counted once per bucket
+			seen := map[string]bool{}
+			for _, value := range documentValues(hit.doc, "features."+facet.Feature) {
+				bucket := FacetBucket{Key: value}
+				if facet.Interval != "" {
+					date, ok := parseDate(value)
+					if !ok {
+						continue
+					}
+					date = truncateDate(date, facet.Interval)
+					bucket = FacetBucket{Key: float64(date.UnixNano() / int64(time.Millisecond)), KeyAsString: date.Format("2006-01-02T15:04:05.000Z")}
+				}
+				id := fmt.Sprint(bucket.Key)
+				if seen[id] {
+					continue
+				}
+				seen[id] = true
+				if _, ok := counts[id]; !ok {
+					counts[id] = &bucket
+				}
+				counts[id].Count++
+			}
+		}
+		buckets := []FacetBucket{}
+		for _, bucket := range counts {
+			buckets = append(buckets, *bucket)
+		}
+		sort.Slice(buckets, func(i, j int) bool {
+			if facet.Interval == "" && buckets[i].Count != buckets[j].Count {
+				return buckets[i].Count > buckets[j].Count
+			}
+			return memoryCompare(buckets[i].Key, buckets[j].Key) < 0
+		})
+		if facet.Interval == "" && facet.Size > 0 && len(buckets) > facet.Size {
+			buckets = buckets[:facet.Size]
+		}
+		result[facet.Feature] = buckets
+	}
+	return result, nil
+}
+
+// find returns all matching entries ordered by resource id
+func (this *MemoryStorage) find(kind string, query SearchQuery) (result []memoryHit, err error) {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	ids := map[string]bool{}
+	for _, id := range query.Ids {
+		ids[id] = true
+	}
+	for _, element := range this.kinds[kind] {
+		if query.Ids != nil && !ids[element.entry.Resource] {
+			continue
+		}
+		if !memoryMatchRights(element.entry, query.Rights, query.User, query.Groups) {
+			continue
+		}
+		hit := memoryHit{kind: kind}
+		hit.entry, err = copyEntry(element.entry)
+		if err != nil {
+			return result, err
+		}
+		hit.doc, err = entryToDocument(hit.entry)
+		if err != nil {
+			return result, err
+		}
+		if query.Selection != nil {
+			match, err := memoryMatchSelection(kind, *query.Selection, hit.doc)
+			if err != nil {
+				return result, err
+			}
+			if !match {
+				continue
+			}
+		}
+		if query.Text != "" {
+			hit.score = memoryTextScore(kind, query, hit.doc)
+			if hit.score == 0 {
+				continue
+			}
+			if query.TextOptions.Highlight {
+				//computed before the projection, which does not limit the highlighted features
+				if highlight := highlightFeatures(textPaths(kind, query), query.Text, query.TextOptions, hit.entry.Features); len(highlight) > 0 {
+					hit.entry.Highlight = highlight
+				}
+			}
+		}
+		result = append(result, hit)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].entry.Resource < result[j].entry.Resource
+	})
+	return
+}
+
+func memoryPage(hits []memoryHit, limit int, offset int) []memoryHit {
+	if limit <= 0 {
+		limit = defaultSearchSize
+	}
+	if offset >= len(hits) {
+		return []memoryHit{}
+	}
+	hits = hits[offset:]
+	if limit < len(hits) {
+		hits = hits[:limit]
+	}
+	return hits
+}
+
+func (this *MemoryStorage) PutDeadLetter(ctx context.Context, letter DeadLetter) error {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	this.deadLetters[letter.Id] = letter
+	return nil
+}
+
+func (this *MemoryStorage) GetDeadLetter(ctx context.Context, id string) (DeadLetter, error) {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	letter, ok := this.deadLetters[id]
+	if !ok {
+		return letter, ErrNotFound
+	}
+	return letter, nil
+}
+
+func (this *MemoryStorage) ListDeadLetters(ctx context.Context, limit int, offset int) (result []DeadLetter, err error) {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	result = []DeadLetter{}
+	for _, letter := range this.deadLetters {
+		result = append(result, letter)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].Time.Equal(result[j].Time) {
+			return result[i].Time.Before(result[j].Time)
+		}
+		return result[i].Id < result[j].Id
+	})
+	if offset >= len(result) {
+		return []DeadLetter{}, nil
+	}
+	result = result[offset:]
+	if limit < len(result) {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+func (this *MemoryStorage) DeleteDeadLetter(ctx context.Context, id string) error {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	if _, ok := this.deadLetters[id]; !ok {
+		return ErrNotFound
+	}
+	delete(this.deadLetters, id)
+	return nil
+}
+
+func (this *MemoryStorage) GetState(ctx context.Context, key string, value interface{}) error {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	state, ok := this.state[key]
+	if !ok {
+		return ErrNotFound
+	}
+	return json.Unmarshal(state, value)
+}
+
+func (this *MemoryStorage) PutState(ctx context.Context, key string, value interface{}) error {
+	state, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	this.state[key] = state
+	return nil
+}
+
+func copyEntry(entry Entry) (result Entry, err error) {
+	temp, err := json.Marshal(entry)
+	if err != nil {
+		return result, err
+	}
+	err = json.Unmarshal(temp, &result)
+	return
+}
+
+// memoryProjectFeatures filters the features like _source includes/excludes of elasticsearch; paths are dotted
+func memoryProjectFeatures(features map[string]interface{}, includes []string, excludes []string) map[string]interface{} {
+	result := map[string]interface{}{}
+	for key, value := range features {
+		subIncludes, included := memoryProjectionPaths(key, includes)
+		subExcludes, excluded := memoryProjectionPaths(key, excludes)
+		if len(includes) > 0 && !included {
+			continue
+		}
+		if excluded && len(subExcludes) == 0 {
+			continue
+		}
+		if sub, ok := value.(map[string]interface{}); ok && (len(subIncludes) > 0 || len(subExcludes) > 0) {
+			value = memoryProjectFeatures(sub, subIncludes, subExcludes)
+		}
+		result[key] = value
+	}
+	return result
+}
+
+// memoryProjectionPaths checks if a path matches the key and returns the remaining paths below the key;
+// a path matching the key itself matches the whole value and results in no remaining paths
+func memoryProjectionPaths(key string, paths []string) (remaining []string, matches bool) {
+	for _, path := range paths {
+		if path == key {
+			return nil, true
+		}
+		if strings.HasPrefix(path, key+".") {
+			remaining = append(remaining, strings.TrimPrefix(path, key+"."))
+			matches = true
+		}
+	}
+	return
+}
+
+func entryToDocument(entry Entry) (result map[string]interface{}, err error) {
+	temp, err := json.Marshal(entry)
+	if err != nil {
+		return result, err
+	}
+	err = json.Unmarshal(temp, &result)
+	return
+}
+
+// documentValues returns all non null values found under the dot separated path; lists are flattened
+func documentValues(doc interface{}, path string) (result []interface{}) {
+	if list, ok := doc.([]interface{}); ok {
+		for _, element := range list {
+			result = append(result, documentValues(element, path)...)
+		}
+		return
+	}
+	if path == "" {
+		if doc != nil {
+			result = append(result, doc)
+		}
+		return
+	}
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return
+	}
+	parts := strings.SplitN(path, ".", 2)
+	rest := ""
+	if len(parts) > 1 {
+		rest = parts[1]
+	}
+	return documentValues(m[parts[0]], rest)
+}
+
+func memoryMatchRights(entry Entry, rights string, user string, groups []string) bool {
+	//like the elastic query: without user and groups no right is restricted
+	if user == "" && len(groups) == 0 {
+		return true
+	}
+	permissions := getPermissions(entry, user, groups)
+	for _, right := range rights {
+		if allowed, ok := permissions[string(right)]; ok && !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+func memoryMatchSelection(kind string, selection Selection, doc map[string]interface{}) (bool, error) {
+	if len(selection.And) > 0 {
+		for _, sub := range selection.And {
+			match, err := memoryMatchSelection(kind, sub, doc)
+			if err != nil || !match {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	if len(selection.Or) > 0 {
+		required := selection.MinimumShouldMatch
+		if required < 1 {
+			required = 1
+		}
+		matches := 0
+		for _, sub := range selection.Or {
+			match, err := memoryMatchSelection(kind, sub, doc)
+			if err != nil {
+				return false, err
+			}
+			if match {
+				matches++
+			}
+		}
+		return matches >= required, nil
+	}
+	if selection.Not != nil {
+		match, err := memoryMatchSelection(kind, *selection.Not, doc)
+		return !match, err
+	}
+	if selection.Nested != nil {
+		for _, element := range documentValues(doc, selection.Nested.Path) {
+			match, err := memoryMatchSelection(kind, selection.Nested.Selection, documentWithValue(doc, selection.Nested.Path, element))
+			if err != nil || match {
+				return match, err
+			}
+		}
+		return false, nil
+	}
+	return memoryMatchCondition(kind, selection.Condition, doc)
+}
+
+// documentWithValue returns a shallow copy of the document where the dot separated path only contains the value
+func documentWithValue(doc map[string]interface{}, path string, value interface{}) map[string]interface{} {
+	result := map[string]interface{}{}
+	for key, element := range doc {
+		result[key] = element
+	}
+	parts := strings.SplitN(path, ".", 2)
+	if len(parts) == 1 {
+		result[parts[0]] = value
+		return result
+	}
+	sub, _ := doc[parts[0]].(map[string]interface{})
+	result[parts[0]] = documentWithValue(sub, parts[1], value)
+	return result
+}
+
+func memoryMatchCondition(kind string, condition ConditionConfig, doc map[string]interface{}) (bool, error) {
+	if err := condition.Validate(kind); err != nil {
+		return false, err
+	}
+	values := documentValues(doc, condition.Feature)
+	val := condition.Value
+	switch condition.Operation {
+	case QueryEqualOperation:
+		if val == nil || val == "" {
+			return len(values) == 0, nil
+		}
+		return memoryContains(values, val), nil
+	case QueryUnequalOperation:
+		if val == nil || val == "" {
+			return len(values) > 0, nil
+		}
+		return !memoryContains(values, val), nil
+	case QueryAnyValueInFeatureOperation:
+		list, err := condition.valueList()
+		if err != nil {
+			return false, err
+		}
+		for _, element := range list {
+			if memoryContains(values, element) {
+				return true, nil
+			}
+		}
+	case QueryExistsOperation:
+		return len(values) > 0, nil
+	case QueryNotExistsOperation:
+		return len(values) == 0, nil
+	case QueryLessOperation, QueryLessEqualOperation, QueryGreaterOperation, QueryGreaterEqualOperation, QueryBetweenOperation:
+		mappingType, _ := fieldType(kind, condition.Feature)
+		lower, upper := val, val
+		if condition.Operation == QueryBetweenOperation {
+			list, err := condition.valueList()
+			if err != nil {
+				return false, err
+			}
+			lower, upper = list[0], list[1]
+		}
+		for _, value := range values {
+			lowerCompare, lowerOk := memoryCompareTyped(mappingType, value, lower)
+			upperCompare, upperOk := memoryCompareTyped(mappingType, value, upper)
+			if !lowerOk || !upperOk {
+				continue
+			}
+			switch condition.Operation {
+			case QueryLessOperation:
+				if upperCompare < 0 {
+					return true, nil
+				}
+			case QueryLessEqualOperation:
+				if upperCompare <= 0 {
+					return true, nil
+				}
+			case QueryGreaterOperation:
+				if lowerCompare > 0 {
+					return true, nil
+				}
+			case QueryGreaterEqualOperation:
+				if lowerCompare >= 0 {
+					return true, nil
+				}
+			case QueryBetweenOperation:
+				if lowerCompare >= 0 && upperCompare <= 0 {
+					return true, nil
+				}
+			}
+		}
+	case QueryPrefixOperation, QueryWildcardOperation, QueryRegexpOperation:
+		pattern := fmt.Sprint(val)
+		switch condition.Operation {
+		case QueryPrefixOperation:
+			pattern = regexp.QuoteMeta(pattern) + ".*"
+		case QueryWildcardOperation:
+			pattern = strings.NewReplacer("\\*", ".*", "\\?", ".").Replace(regexp.QuoteMeta(pattern))
+		}
+		//like lucene regular expressions the pattern has to match the whole value and "." matches any character
+		expression, err := regexp.Compile("^(?s:" + pattern + ")$")
+		if err != nil {
+			return false, err
+		}
+		for _, value := range values {
+			if expression.MatchString(fmt.Sprint(value)) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// memoryCompareTyped compares a document value with a condition value like elasticsearch compares values of the mapping type
+func memoryCompareTyped(mappingType string, a interface{}, b interface{}) (int, bool) {
+	switch {
+	case numericMappingTypes[mappingType]:
+		aNumber, aOk := toFloat(a)
+		bNumber, bOk := toFloat(b)
+		return memoryCompare(aNumber, bNumber), aOk && bOk
+	case mappingType == "date":
+		aDate, aOk := parseDate(a)
+		bDate, bOk := parseDate(b)
+		return memoryCompare(float64(aDate.UnixNano()), float64(bDate.UnixNano())), aOk && bOk
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b)), true
+}
+
+func memoryContains(values []interface{}, value interface{}) bool {
+	for _, element := range values {
+		if fmt.Sprint(element) == fmt.Sprint(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// memorySort orders the hits by the sort fields of the query and returns the fields
+func memorySort(kind string, query SearchQuery, hits []memoryHit) []sortField {
+	keys := query.sortFields(kind)
+	for i := range hits {
+		hits[i].sort = memorySortValues(hits[i], keys)
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		return memoryCompareSortValues(hits[i].sort, hits[j].sort, keys) < 0
+	})
+	return keys
+}
+
+// memorySortValues returns the values of the sort keys like elasticsearch: lists are represented by their min (asc) or max (desc) value
+func memorySortValues(hit memoryHit, keys []sortField) (result []interface{}) {
+	for _, key := range keys {
+		switch key.field {
+		case scoreSortKey:
+			result = append(result, float64(hit.score))
+		case "resource":
+			result = append(result, hit.entry.Resource)
+		default:
+			values := documentValues(hit.doc, key.field)
+			if key.lowercase {
+				for i, value := range values {
+					if str, ok := value.(string); ok {
+						values[i] = strings.ToLower(str)
+					}
+				}
+			}
+			if len(values) == 0 {
+				result = append(result, nil)
+			} else {
+				result = append(result, memorySortValue(values, key.asc))
+			}
+		}
+	}
+	return
+}
+
+// memoryCompareSortValues orders like elasticsearch: by the direction of each key and missing values last
+func memoryCompareSortValues(a []interface{}, b []interface{}, keys []sortField) int {
+	for i, key := range keys {
+		if i >= len(a) || i >= len(b) {
+			return len(a) - len(b)
+		}
+		if a[i] == nil || b[i] == nil {
+			if a[i] == nil && b[i] != nil {
+				return 1
+			}
+			if a[i] != nil && b[i] == nil {
+				return -1
+			}
+			continue
+		}
+		compare := memoryCompare(a[i], b[i])
+		if !key.asc {
+			compare = -compare
+		}
+		if compare != 0 {
+			return compare
+		}
+	}
+	return 0
+}
+
+func memorySortValue(values []interface{}, asc bool) (result interface{}) {
+	result = values[0]
+	for _, value := range values[1:] {
+		compare := memoryCompare(value, result)
+		if (asc && compare < 0) || (!asc && compare > 0) {
+			result = value
+		}
+	}
+	return
+}
+
+func memoryCompare(a interface{}, b interface{}) int {
+	//sort values of cursors are decoded as json.Number
+	if number, ok := a.(json.Number); ok {
+		a, _ = number.Float64()
+	}
+	if number, ok := b.(json.Number); ok {
+		b, _ = number.Float64()
+	}
+	aNumber, aIsNumber := a.(float64)
+	bNumber, bIsNumber := b.(float64)
+	if aIsNumber && bIsNumber {
+		switch {
+		case aNumber < bNumber:
+			return -1
+		case aNumber > bNumber:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// memoryTextScore counts the query tokens matching the edge_ngram analyzed feature_search copies or the TextFeature;
+// in phrase and prefix mode all tokens have to match consecutive tokens of one feature value
+func memoryTextScore(kind string, query SearchQuery, doc map[string]interface{}) (score int) {
+	tokens := tokenize(query.Text)
+	options := query.TextOptions
+	values := [][]string{}
+	for _, path := range textPaths(kind, query) {
+		for _, value := range documentValues(doc, path) {
+			values = append(values, tokenize(fmt.Sprint(value)))
+		}
+	}
+	if options.Mode == TextPhraseMode || options.Mode == TextPrefixMode {
+		for _, valueTokens := range values {
+			if matchPhrase(tokens, valueTokens, options) {
+				return len(tokens)
+			}
+		}
+		return 0
+	}
+	for _, token := range tokens {
+		if matchAnyToken(token, values, options) {
+			score++
+		}
+	}
+	return
+}
+
+func matchAnyToken(token string, values [][]string, options TextOptions) bool {
+	for _, valueTokens := range values {
+		for _, valueToken := range valueTokens {
+			if matchToken(token, valueToken, options) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func searchFeaturePaths(prefix string, mapping map[string]interface{}) (result []string) {
+	for name, field := range mapping {
+		fieldMapping, ok := field.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if properties, ok := fieldMapping["properties"].(map[string]interface{}); ok {
+			result = append(result, searchFeaturePaths(prefix+"."+name, properties)...)
+		}
+		copyTo := fieldMapping["copy_to"]
+		if copyTo == "feature_search" || memoryContains(documentValues(copyTo, ""), "feature_search") {
+			result = append(result, prefix+"."+name)
+		}
+	}
+	return
+}
+
+func tokenize(text string) (result []string) {
+	tokens := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+	for _, token := range tokens {
+		result = append(result, strings.ToLower(token))
+	}
+	return
+}
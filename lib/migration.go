@@ -18,37 +18,102 @@ package lib
 
 import (
 	"context"
-	"encoding/json"
 	"log"
-
-	"github.com/olivere/elastic"
+	"reflect"
 )
 
-func UpdateInitialGroupRights() {
+// UpdateInitialGroupRights applies the InitialGroupRights of each kind to all of its entries
+// and returns the number of changed entries per kind
+func UpdateInitialGroupRights() (changed map[string]int, err error) {
+	changed = map[string]int{}
 	for kind, resourceConfig := range Config.Resources {
-		for group, right := range resourceConfig.InitialGroupRights {
-			updateInitialResourceGroupRights(kind, group, right)
+		changed[kind], err = updateInitialResourceGroupRights(kind, resourceConfig.InitialGroupRights)
+		if err != nil {
+			log.Println("ERROR: unable to update initial group rights; ", kind, err)
+			return
 		}
+		log.Println("updated initial group rights of", changed[kind], kind, "entries")
 	}
+	return changed, saveInitialGroupRightsState()
 }
 
-func updateInitialResourceGroupRights(kind string, group string, right string) {
-	resources, err := getAllResources(kind)
-	if err != nil {
-		log.Println("ERROR: unable to find resources to update grouprights; ", kind, group, right, err)
-		return
+func updateInitialResourceGroupRights(kind string, rights map[string]string) (changed int, err error) {
+	if len(rights) == 0 {
+		return 0, nil
 	}
-	for _, resource := range resources {
-		err = SetGroupRight(kind, resource.Resource, group, right)
+	return updateAllEntries(context.Background(), kind, false, func(entry *Entry) bool {
+		return applyGroupRights(entry, rights)
+	})
+}
+
+// updateAllEntries calls update on every entry of the kind and writes the entries it reports as changed in bulk;
+// with dryRun nothing is written and the number of entries that would change is returned.
+// A RightsChangedEvent is sent for each written entry.
+func updateAllEntries(ctx context.Context, kind string, dryRun bool, update func(entry *Entry) bool) (changed int, err error) {
+	err = getAllResources(ctx, kind, func(batch []VersionedEntry) error {
+		updates := []VersionedEntry{}
+		changes := map[string][]RightsChange{}
+		for _, element := range batch {
+			before := element.Entry.ToResourceRights()
+			if update(&element.Entry) {
+				updates = append(updates, element)
+				changes[element.Entry.Resource] = diffRights(before, element.Entry.ToResourceRights())
+			}
+		}
+		if dryRun {
+			changed = changed + len(updates)
+			return nil
+		}
+		conflicts, err := GetStorage().PutBulk(ctx, kind, updates)
 		if err != nil {
-			log.Println("ERROR: unable to update resources grouprights; ", kind, group, right, err)
-			return
+			return err
+		}
+		changed = changed + len(updates) - len(conflicts)
+		for _, resource := range conflicts {
+			delete(changes, resource)
+		}
+		for resource, rights := range changes {
+			notifyChange(ChangeEvent{Type: RightsChangedEvent, Kind: kind, Resource: resource, Rights: rights})
+		}
+		//entries changed since the scroll started are updated one by one
+		for _, resource := range conflicts {
+			written := false
+			var rights []RightsChange
+			err = updateEntryIf(ctx, kind, resource, func(entry *Entry) bool {
+				before := entry.ToResourceRights()
+				written = update(entry)
+				rights = diffRights(before, entry.ToResourceRights())
+				return written
+			})
+			if err == ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if written {
+				changed++
+				notifyChange(ChangeEvent{Type: RightsChangedEvent, Kind: kind, Resource: resource, Rights: rights})
+			}
 		}
+		return nil
+	})
+	return
+}
+
+// applyGroupRights replaces the rights of the given groups and reports if the entry has been changed
+func applyGroupRights(entry *Entry, rights map[string]string) bool {
+	before := entry.ToResourceRights().GroupRights
+	for group, right := range rights {
+		entry.removeGroupRights(group)
+		entry.addGroupRights(group, right)
 	}
+	return !reflect.DeepEqual(before, entry.ToResourceRights().GroupRights)
 }
-func getAllResources(kind string) (resources []Entry, err error) {
-	log.Fatal("not implemented")
-	return
+
+// getAllResources passes every entry of the kind in batches to handler
+func getAllResources(ctx context.Context, kind string, handler func(batch []VersionedEntry) error) error {
+	return GetStorage().Scroll(ctx, kind, SearchQuery{}, scrollBatchSize(), handler)
 }
 
 func Import(imports map[string][]ResourceRights) (err error) {
@@ -64,9 +129,9 @@ func Import(imports map[string][]ResourceRights) (err error) {
 
 func ImportResource(kind string, resource ResourceRights) (err error) {
 	ctx := context.Background()
-	entry := Entry{Resource: resource.ResourceId, Features: resource.Features, Creator: resource.Creator}
+	entry := Entry{Resource: resource.ResourceId, Features: resource.Features, Creator: resource.Creator, EventVersion: resource.Version}
 	entry.SetResourceRights(resource)
-	_, err = GetClient().Index().Index(kind).Type(ElasticPermissionType).Id(resource.ResourceId).BodyJson(entry).Do(ctx)
+	err = GetStorage().Put(ctx, kind, entry, Version{})
 	return
 }
 
@@ -81,41 +146,24 @@ func Export() (exports map[string][]ResourceRights, err error) {
 	return
 }
 
+// ExportKindAll exports all entries of the kind from one scroll snapshot
 func ExportKindAll(kind string) (result []ResourceRights, err error) {
 	result = []ResourceRights{}
-	limit := 100
-	offset := 0
-	for {
-		temp, err := ExportKind(kind, limit, offset)
-		if err != nil {
-			return result, err
-		}
-		result = append(result, temp...)
-		if len(temp) < limit {
-			return result, err
+	err = GetStorage().Scroll(context.Background(), kind, SearchQuery{}, scrollBatchSize(), func(batch []VersionedEntry) error {
+		for _, element := range batch {
+			result = append(result, element.Entry.ToResourceRights())
 		}
-		offset = offset + limit
-	}
+		return nil
+	})
 	return
 }
 
 func ExportKind(kind string, limit int, offset int) (result []ResourceRights, err error) {
-	ctx := context.Background()
-	query := elastic.NewMatchAllQuery()
-	resp, err := GetClient().Search().Index(kind).Type(ElasticPermissionType).Query(query).Size(limit).From(offset).Do(ctx)
+	entries, err := GetStorage().Export(context.Background(), kind, limit, offset)
 	if err != nil {
 		return result, err
 	}
-	for _, hit := range resp.Hits.Hits {
-		if hit.Type != ElasticPermissionType {
-			log.Println("DEBUG: unknown type", hit.Type)
-			continue
-		}
-		entry := Entry{}
-		err = json.Unmarshal(*hit.Source, &entry)
-		if err != nil {
-			return result, err
-		}
+	for _, entry := range entries {
 		result = append(result, entry.ToResourceRights())
 	}
 	return
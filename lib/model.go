@@ -19,6 +19,7 @@ package lib
 import (
 	"encoding/json"
 	"log"
+	"strings"
 )
 
 const ElasticPermissionType = "resource"
@@ -68,7 +69,7 @@ func (entry *Entry) addGroupRights(group string, rights string) {
 		case 'w':
 			entry.WriteGroups = append(entry.WriteGroups, group)
 		case 'x':
-			entry.ExecuteGroups = append(entry.AdminGroups, group)
+			entry.ExecuteGroups = append(entry.ExecuteGroups, group)
 		}
 	}
 }
@@ -115,6 +116,7 @@ type ResourceRights struct {
 	UserRights  map[string]Right       `json:"user_rights"`
 	GroupRights map[string]Right       `json:"group_rights"`
 	Creator     string                 `json:"creator"`
+	Version     int64                  `json:"version,omitempty"` //Entry.EventVersion
 }
 
 type Right struct {
@@ -136,6 +138,8 @@ type Entry struct {
 	ExecuteUsers  []string               `json:"execute_users"`
 	ExecuteGroups []string               `json:"execute_groups"`
 	Creator       string                 `json:"creator"`
+	EventVersion  int64                  `json:"event_version,omitempty"` //version of the last applied resource event (ResourceConfig.VersionPath)
+	Highlight     map[string][]string    `json:"-"`                       //matching values per feature of a search hit with TextOptions.Highlight; not stored
 }
 
 func (this *Entry) SetResourceRights(rights ResourceRights) {
@@ -173,6 +177,7 @@ func (entry Entry) ToResourceRights() (result ResourceRights) {
 	result.ResourceId = entry.Resource
 	result.Features = entry.Features
 	result.Creator = entry.Creator
+	result.Version = entry.EventVersion
 	result.UserRights = map[string]Right{}
 	for _, user := range entry.AdminUsers {
 		if _, ok := result.UserRights[user]; !ok {
@@ -254,10 +259,127 @@ const ElasticPermissionMapping = `{
 	"write_groups":   {"type": "keyword"},
 	"write_users":    {"type": "keyword"},
 	"creator":    	  {"type": "keyword"},
+	"event_version":  {"type": "long"},
 	"feature_search": {"type": "text", "analyzer": "autocomplete", "search_analyzer": "standard"}
 }`
 
-func createMapping(kind string) (result map[string]map[string]map[string]map[string]interface{}, err error) {
+const DeadLetterMapping = `{
+	"id":       {"type": "keyword"},
+	"topic":    {"type": "keyword"},
+	"payload":  {"type": "text", "index": false},
+	"error":    {"type": "text", "index": false},
+	"attempts": {"type": "long"},
+	"time":     {"type": "date"}
+}`
+
+// StateIndex stores the state of the service, like the InitialGroupRights applied by the last update
+const StateIndex = "service_state"
+
+const StateMapping = `{
+	"value": {"type": "object", "enabled": false}
+}`
+
+// featureMapping returns the ElasticMapping of a feature of the kind; the feature may have field.subfield syntax
+func featureMapping(kind string, feature string) (result map[string]interface{}, ok bool) {
+	properties := Config.ElasticMapping[kind]
+	for _, part := range strings.Split(feature, ".") {
+		if properties == nil {
+			return result, false
+		}
+		result, ok = properties[part].(map[string]interface{})
+		if !ok {
+			return result, false
+		}
+		properties, _ = result["properties"].(map[string]interface{})
+	}
+	return result, ok
+}
+
+// fieldType returns the mapping type of a field of the kinds index, like "features.name" or "admin_users"; objects have the type "object"
+func fieldType(kind string, field string) (result string, ok bool) {
+	var mapping map[string]interface{}
+	if strings.HasPrefix(field, "features.") {
+		mapping, ok = featureMapping(kind, strings.TrimPrefix(field, "features."))
+	} else {
+		permissionMapping := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(ElasticPermissionMapping), &permissionMapping); err != nil {
+			return result, false
+		}
+		mapping, ok = permissionMapping[field].(map[string]interface{})
+	}
+	if !ok {
+		return result, false
+	}
+	result, _ = mapping["type"].(string)
+	if result == "" {
+		result = "object"
+	}
+	return result, true
+}
+
+// lowercaseSortOption may be set to true in the ElasticMapping of a keyword feature to sort it case-insensitive;
+// the feature gets the sub-field lowercaseSortField with the lowercase normalizer, which is used for sorting automatically
+const lowercaseSortOption = "lowercase_sort"
+const lowercaseSortField = "lowercase"
+const lowercaseNormalizer = "lowercase_normalizer"
+
+func lowercaseSorted(kind string, feature string) bool {
+	mapping, ok := featureMapping(kind, feature)
+	return ok && mapping["type"] == "keyword" && mapping[lowercaseSortOption] == true
+}
+
+// elasticFeatureMappings returns a copy of the configured feature mappings where lowercaseSortOption is replaced by its sub-field
+func elasticFeatureMappings(properties map[string]interface{}) map[string]interface{} {
+	result := map[string]interface{}{}
+	for name, value := range properties {
+		field, ok := value.(map[string]interface{})
+		if !ok {
+			result[name] = value
+			continue
+		}
+		mapping := map[string]interface{}{}
+		for key, value := range field {
+			mapping[key] = value
+		}
+		if sub, ok := field["properties"].(map[string]interface{}); ok {
+			mapping["properties"] = elasticFeatureMappings(sub)
+		}
+		if _, ok := mapping[lowercaseSortOption]; ok {
+			delete(mapping, lowercaseSortOption)
+			if field[lowercaseSortOption] == true {
+				if field["type"] != "keyword" {
+					log.Println("WARNING: ignore", lowercaseSortOption, "of", name, "; only supported for keyword features")
+				} else {
+					fields := map[string]interface{}{}
+					if existing, ok := field["fields"].(map[string]interface{}); ok {
+						for key, value := range existing {
+							fields[key] = value
+						}
+					}
+					fields[lowercaseSortField] = map[string]interface{}{"type": "keyword", "normalizer": lowercaseNormalizer}
+					mapping["fields"] = fields
+				}
+			}
+		}
+		result[name] = mapping
+	}
+	return result
+}
+
+// typedMappings wraps the properties of an index in the document type used by elasticsearch 6
+func typedMappings(properties map[string]interface{}) map[string]interface{} {
+	mappings := map[string]interface{}{
+		"properties": properties,
+	}
+	if !elasticTypeless {
+		mappings = map[string]interface{}{
+			ElasticPermissionType: mappings,
+		}
+	}
+	return mappings
+}
+
+func createMapping(kind string) (result map[string]interface{}, err error) {
 	mapping := map[string]interface{}{}
 	err = json.Unmarshal([]byte(ElasticPermissionMapping), &mapping)
 	if err != nil {
@@ -266,16 +388,12 @@ func createMapping(kind string) (result map[string]map[string]map[string]map[str
 	}
 	if featureMappings, ok := Config.ElasticMapping[kind]; ok {
 		mapping["features"] = map[string]interface{}{
-			"properties": featureMappings,
+			"properties": elasticFeatureMappings(featureMappings),
 		}
 	}
-	result = map[string]map[string]map[string]map[string]interface{}{
-		"mappings": {
-			ElasticPermissionType: {
-				"properties": mapping,
-			},
-		},
-		"settings": {
+	result = map[string]interface{}{
+		"mappings": typedMappings(mapping),
+		"settings": map[string]map[string]map[string]interface{}{
 			"analysis": {
 				"filter": {
 					"autocomplete_filter": map[string]interface{}{
@@ -284,6 +402,12 @@ func createMapping(kind string) (result map[string]map[string]map[string]map[str
 						"max_gram": 20,
 					},
 				},
+				"normalizer": {
+					lowercaseNormalizer: map[string]interface{}{
+						"type":   "custom",
+						"filter": []string{"lowercase"},
+					},
+				},
 				"analyzer": {
 					"autocomplete": map[string]interface{}{
 						"type":      "custom",
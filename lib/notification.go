@@ -0,0 +1,129 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package lib
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// types of ChangeEvent
+const (
+	RightsChangedEvent   = "rights"   //rights of one user or group have been set or deleted
+	FeaturesChangedEvent = "features" //features have been updated or the resource has been created
+	ResourceDeletedEvent = "delete"   //all users and groups lost their rights
+)
+
+// ChangeEvent is published to Config.NotificationTopic after an entry has been changed
+type ChangeEvent struct {
+	Type     string         `json:"type"`
+	Kind     string         `json:"kind"`
+	Resource string         `json:"resource"`
+	Rights   []RightsChange `json:"rights"` //users and groups affected by the change; empty if only features changed
+	Time     time.Time      `json:"time"`
+}
+
+// RightsChange describes the rights of one user or group before and after a change, like "arwx"; "" is no right
+type RightsChange struct {
+	User   string `json:"user,omitempty"`
+	Group  string `json:"group,omitempty"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+func (entry Entry) userRights(user string) string {
+	return rightToString(entry.ToResourceRights().UserRights[user])
+}
+
+func (entry Entry) groupRights(group string) string {
+	return rightToString(entry.ToResourceRights().GroupRights[group])
+}
+
+// rightsChanges lists all users and groups of the entry with their rights as after or, if removed, as before
+func (entry Entry) rightsChanges(removed bool) (result []RightsChange) {
+	rights := entry.ToResourceRights()
+	change := func(right Right) RightsChange {
+		if removed {
+			return RightsChange{Before: rightToString(right)}
+		}
+		return RightsChange{After: rightToString(right)}
+	}
+	for user, right := range rights.UserRights {
+		element := change(right)
+		element.User = user
+		result = append(result, element)
+	}
+	for group, right := range rights.GroupRights {
+		element := change(right)
+		element.Group = group
+		result = append(result, element)
+	}
+	sortRightsChanges(result)
+	return
+}
+
+// diffRights lists the users and groups whose rights differ between before and after
+func diffRights(before ResourceRights, after ResourceRights) (result []RightsChange) {
+	for user := range unionKeys(before.UserRights, after.UserRights) {
+		change := RightsChange{User: user, Before: rightToString(before.UserRights[user]), After: rightToString(after.UserRights[user])}
+		if change.Before != change.After {
+			result = append(result, change)
+		}
+	}
+	for group := range unionKeys(before.GroupRights, after.GroupRights) {
+		change := RightsChange{Group: group, Before: rightToString(before.GroupRights[group]), After: rightToString(after.GroupRights[group])}
+		if change.Before != change.After {
+			result = append(result, change)
+		}
+	}
+	sortRightsChanges(result)
+	return
+}
+
+func unionKeys(a map[string]Right, b map[string]Right) map[string]bool {
+	result := map[string]bool{}
+	for key := range a {
+		result[key] = true
+	}
+	for key := range b {
+		result[key] = true
+	}
+	return result
+}
+
+func sortRightsChanges(changes []RightsChange) {
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].User != changes[j].User {
+			return changes[i].User < changes[j].User
+		}
+		return changes[i].Group < changes[j].Group
+	})
+}
+
+// notifyChange publishes the event to Config.NotificationTopic if set; a failed publish is logged because the change is already stored
+func notifyChange(event ChangeEvent) {
+	if Config.NotificationTopic == "" {
+		return
+	}
+	if event.Rights == nil {
+		event.Rights = []RightsChange{}
+	}
+	event.Time = time.Now().UTC()
+	if err := sendEvent(Config.NotificationTopic, event); err != nil {
+		log.Println("ERROR: unable to send change notification", event.Type, event.Kind, event.Resource, err)
+	}
+}
@@ -18,14 +18,9 @@ package lib
 
 import (
 	"context"
-	"log"
 	"strconv"
 
-	"encoding/json"
-
 	"errors"
-
-	"github.com/olivere/elastic"
 )
 
 func ResourceExists(kind string, resource string) (exists bool, err error) {
@@ -33,8 +28,7 @@ func ResourceExists(kind string, resource string) (exists bool, err error) {
 }
 
 func resourceExists(context context.Context, kind string, resource string) (exists bool, err error) {
-	exists, err = elastic.NewExistsService(GetClient()).Index(kind).Type(ElasticPermissionType).Id(resource).Do(context)
-	return
+	return GetStorage().Exists(context, kind, resource)
 }
 
 func interfaceSlice(strings []string) (result []interface{}) {
@@ -44,77 +38,56 @@ func interfaceSlice(strings []string) (result []interface{}) {
 	return
 }
 
-func getRightsQuery(rights string, user string, groups []string) (result []elastic.Query) {
-	for _, right := range rights {
-		switch right {
-		case 'a':
-			or := []elastic.Query{}
-			if user != "" {
-				or = append(or, elastic.NewTermQuery("admin_users", user))
-			}
-			if len(groups) > 0 {
-				or = append(or, elastic.NewTermsQuery("admin_groups", interfaceSlice(groups)...))
-			}
-			result = append(result, elastic.NewBoolQuery().Filter(elastic.NewBoolQuery().Should(or...)))
-		case 'r':
-			or := []elastic.Query{}
-			if user != "" {
-				or = append(or, elastic.NewTermQuery("read_users", user))
-			}
-			if len(groups) > 0 {
-				or = append(or, elastic.NewTermsQuery("read_groups", interfaceSlice(groups)...))
-			}
-			result = append(result, elastic.NewBoolQuery().Filter(elastic.NewBoolQuery().Should(or...)))
-		case 'w':
-			or := []elastic.Query{}
-			if user != "" {
-				or = append(or, elastic.NewTermQuery("write_users", user))
-			}
-			if len(groups) > 0 {
-				or = append(or, elastic.NewTermsQuery("write_groups", interfaceSlice(groups)...))
-			}
-			result = append(result, elastic.NewBoolQuery().Filter(elastic.NewBoolQuery().Should(or...)))
-		case 'x':
-			or := []elastic.Query{}
-			if user != "" {
-				or = append(or, elastic.NewTermQuery("execute_users", user))
-			}
-			if len(groups) > 0 {
-				or = append(or, elastic.NewTermsQuery("execute_groups", interfaceSlice(groups)...))
-			}
-			result = append(result, elastic.NewBoolQuery().Filter(elastic.NewBoolQuery().Should(or...)))
+func toResourceRightsList(entries []Entry) (result []ResourceRights) {
+	for _, entry := range entries {
+		result = append(result, entry.ToResourceRights())
+	}
+	return
+}
+
+func toFeatureList(entries []Entry, user string, groups []string) (result []map[string]interface{}) {
+	for _, entry := range entries {
+		if entry.Features == nil {
+			entry.Features = map[string]interface{}{}
 		}
+		entry.Features["id"] = entry.Resource
+		entry.Features["creator"] = entry.Creator
+		entry.Features["permissions"] = getPermissions(entry, user, groups)
+		if entry.Highlight != nil {
+			entry.Features["highlight"] = entry.Highlight
+		}
+		result = append(result, entry.Features)
 	}
 	return
 }
 
+func toIdList(entries []Entry) (result []string) {
+	for _, entry := range entries {
+		result = append(result, entry.Resource)
+	}
+	return
+}
+
+func parseLimitOffset(limitStr string, offsetStr string) (limit int, offset int, err error) {
+	limit, err = strconv.Atoi(limitStr)
+	if err != nil {
+		return
+	}
+	offset, err = strconv.Atoi(offsetStr)
+	return
+}
+
 func GetRightsToAdministrate(kind string, user string, groups []string) (result []ResourceRights, err error) {
-	ctx := context.Background()
-	query := elastic.NewBoolQuery().Filter(getRightsQuery("a", user, groups)...)
-	resp, err := GetClient().Search().Index(kind).Type(ElasticPermissionType).Version(true).Query(query).Do(ctx)
+	resp, err := GetStorage().Search(context.Background(), kind, SearchQuery{Rights: "a", User: user, Groups: groups})
 	if err != nil {
 		return result, err
 	}
-	for _, hit := range resp.Hits.Hits {
-		if hit.Type != ElasticPermissionType {
-			log.Println("DEBUG: GetRightsToAdministrate: unknown type", hit.Type)
-			continue
-		}
-		entry := Entry{}
-		err = json.Unmarshal(*hit.Source, &entry)
-		if err != nil {
-			return result, err
-		}
-		result = append(result, entry.ToResourceRights())
-	}
-	return
+	return toResourceRightsList(resp.Hits), nil
 }
 
 func CheckUserOrGroup(kind string, resource string, user string, groups []string, rights string) (err error) {
-	ctx := context.Background()
-	query := elastic.NewBoolQuery().Filter(append(getRightsQuery(rights, user, groups), elastic.NewTermQuery("resource", resource))...)
-	resp, err := GetClient().Search().Index(kind).Type(ElasticPermissionType).Version(true).Query(query).Size(1).Do(ctx)
-	if err == nil && resp.Hits.TotalHits == 0 {
+	resp, err := GetStorage().Search(context.Background(), kind, SearchQuery{Rights: rights, User: user, Groups: groups, Ids: []string{resource}, Limit: 1})
+	if err == nil && resp.Total == 0 {
 		err = errors.New("access denied")
 	}
 	return
@@ -122,106 +95,42 @@ func CheckUserOrGroup(kind string, resource string, user string, groups []string
 
 func CheckListUserOrGroup(kind string, ids []string, user string, groups []string, rights string) (allowed map[string]bool, err error) {
 	allowed = map[string]bool{}
-	ctx := context.Background()
-	terms := []interface{}{}
-	for _, id := range ids {
-		terms = append(terms, id)
-	}
-	query := elastic.NewBoolQuery().Filter(append(getRightsQuery(rights, user, groups), elastic.NewTermsQuery("resource", terms...))...)
-	resp, err := GetClient().Search().Index(kind).Type(ElasticPermissionType).Query(query).Size(len(ids)).Do(ctx)
+	resp, err := GetStorage().Search(context.Background(), kind, SearchQuery{Rights: rights, User: user, Groups: groups, Ids: ids, Limit: len(ids)})
 	if err != nil {
 		return allowed, err
 	}
-	for _, hit := range resp.Hits.Hits {
-		entry := Entry{}
-		err = json.Unmarshal(*hit.Source, &entry)
-		if err != nil {
-			return allowed, err
-		}
+	for _, entry := range resp.Hits {
 		allowed[entry.Resource] = true
 	}
 	return allowed, nil
 }
 
 func GetListFromIds(kind string, ids []string, user string, groups []string, rights string) (result []map[string]interface{}, err error) {
-	ctx := context.Background()
-	terms := []interface{}{}
-	for _, id := range ids {
-		terms = append(terms, id)
-	}
-	query := elastic.NewBoolQuery().Filter(append(getRightsQuery(rights, user, groups), elastic.NewTermsQuery("resource", terms...))...)
-	resp, err := GetClient().Search().Index(kind).Type(ElasticPermissionType).Query(query).Size(len(ids)).Do(ctx)
+	resp, err := GetStorage().Search(context.Background(), kind, SearchQuery{Rights: rights, User: user, Groups: groups, Ids: ids, Limit: len(ids)})
 	if err != nil {
 		return result, err
 	}
-	for _, hit := range resp.Hits.Hits {
-		entry := Entry{}
-		err = json.Unmarshal(*hit.Source, &entry)
-		if err != nil {
-			return result, err
-		}
-		entry.Features["id"] = entry.Resource
-		entry.Features["creator"] = entry.Creator
-		entry.Features["permissions"] = getPermissions(entry, user, groups)
-		result = append(result, entry.Features)
-	}
-	return result, nil
+	return toFeatureList(resp.Hits, user, groups), nil
 }
 
 func GetListFromIdsOrdered(kind string, ids []string, user string, groups []string, rights string, limitStr string, offsetStr string, orderfeature string, asc bool) (result []map[string]interface{}, err error) {
-	limit, err := strconv.Atoi(limitStr)
+	limit, offset, err := parseLimitOffset(limitStr, offsetStr)
 	if err != nil {
 		return result, err
 	}
-	offset, err := strconv.Atoi(offsetStr)
+	resp, err := GetStorage().Search(context.Background(), kind, SearchQuery{Rights: rights, User: user, Groups: groups, Ids: ids, Limit: limit, Offset: offset, Sort: sortBy(orderfeature, asc)})
 	if err != nil {
 		return result, err
 	}
-	ctx := context.Background()
-	terms := []interface{}{}
-	for _, id := range ids {
-		terms = append(terms, id)
-	}
-	query := elastic.NewBoolQuery().Filter(append(getRightsQuery(rights, user, groups), elastic.NewTermsQuery("resource", terms...))...)
-	resp, err := GetClient().Search().Index(kind).Type(ElasticPermissionType).Query(query).Size(limit).From(offset).Sort("features."+orderfeature, asc).Do(ctx)
-	if err != nil {
-		return result, err
-	}
-	for _, hit := range resp.Hits.Hits {
-		entry := Entry{}
-		err = json.Unmarshal(*hit.Source, &entry)
-		if err != nil {
-			return result, err
-		}
-		entry.Features["id"] = entry.Resource
-		entry.Features["creator"] = entry.Creator
-		entry.Features["permissions"] = getPermissions(entry, user, groups)
-		result = append(result, entry.Features)
-	}
-	return result, nil
+	return toFeatureList(resp.Hits, user, groups), nil
 }
 
 func GetFullListForUserOrGroup(kind string, user string, groups []string, rights string) (result []map[string]interface{}, err error) {
-	limit := 20
-	offset := 0
-	temp := []map[string]interface{}{}
-	for ok := true; ok; ok = len(temp) > 0 {
-		temp, err = getListForUserOrGroup(kind, user, groups, rights, limit, offset)
-		if err != nil {
-			return result, err
-		}
-		result = append(result, temp...)
-		offset = offset + limit
-	}
-	return
+	return listAll(kind, SearchQuery{Rights: rights, User: user, Groups: groups})
 }
 
 func GetListForUserOrGroup(kind string, user string, groups []string, rights string, limitStr string, offsetStr string) (result []map[string]interface{}, err error) {
-	limit, err := strconv.Atoi(limitStr)
-	if err != nil {
-		return result, err
-	}
-	offset, err := strconv.Atoi(offsetStr)
+	limit, offset, err := parseLimitOffset(limitStr, offsetStr)
 	if err != nil {
 		return result, err
 	}
@@ -229,106 +138,52 @@ func GetListForUserOrGroup(kind string, user string, groups []string, rights str
 }
 
 func getListForUserOrGroup(kind string, user string, groups []string, rights string, limit int, offset int) (result []map[string]interface{}, err error) {
-	ctx := context.Background()
-	query := elastic.NewBoolQuery().Filter(getRightsQuery(rights, user, groups)...)
-	resp, err := GetClient().Search().Index(kind).Type(ElasticPermissionType).Version(true).Query(query).Size(limit).From(offset).Do(ctx)
+	resp, err := GetStorage().Search(context.Background(), kind, SearchQuery{Rights: rights, User: user, Groups: groups, Limit: limit, Offset: offset})
 	if err != nil {
 		return result, err
 	}
-	for _, hit := range resp.Hits.Hits {
-		entry := Entry{}
-		err = json.Unmarshal(*hit.Source, &entry)
-		if err != nil {
-			return result, err
-		}
-		entry.Features["id"] = entry.Resource
-		entry.Features["creator"] = entry.Creator
-		entry.Features["permissions"] = getPermissions(entry, user, groups)
-		result = append(result, entry.Features)
-	}
-	return
+	return toFeatureList(resp.Hits, user, groups), nil
 }
 
 func GetOrderedListForUserOrGroup(kind string, user string, groups []string, rights string, limitStr string, offsetStr string, orderfeature string, asc bool) (result []map[string]interface{}, err error) {
-	limit, err := strconv.Atoi(limitStr)
+	limit, offset, err := parseLimitOffset(limitStr, offsetStr)
 	if err != nil {
 		return result, err
 	}
-	offset, err := strconv.Atoi(offsetStr)
+	resp, err := GetStorage().Search(context.Background(), kind, SearchQuery{Rights: rights, User: user, Groups: groups, Limit: limit, Offset: offset, Sort: sortBy(orderfeature, asc)})
 	if err != nil {
 		return result, err
 	}
-	ctx := context.Background()
-	query := elastic.NewBoolQuery().Filter(getRightsQuery(rights, user, groups)...)
-	resp, err := GetClient().Search().Index(kind).Type(ElasticPermissionType).Version(true).Query(query).Size(limit).From(offset).Sort("features."+orderfeature, asc).Do(ctx)
-	if err != nil {
-		return result, err
-	}
-	for _, hit := range resp.Hits.Hits {
-		entry := Entry{}
-		err = json.Unmarshal(*hit.Source, &entry)
-		if err != nil {
-			return result, err
-		}
-		entry.Features["id"] = entry.Resource
-		entry.Features["creator"] = entry.Creator
-		entry.Features["permissions"] = getPermissions(entry, user, groups)
-		result = append(result, entry.Features)
-	}
-	return
+	return toFeatureList(resp.Hits, user, groups), nil
 }
 
 func GetListForUser(kind string, user string, rights string) (result []string, err error) {
-	ctx := context.Background()
-	query := elastic.NewBoolQuery().Filter(getRightsQuery(rights, user, []string{})...)
-	resp, err := GetClient().Search().Index(kind).Type(ElasticPermissionType).Version(true).Query(query).Do(ctx)
+	resp, err := GetStorage().Search(context.Background(), kind, SearchQuery{Rights: rights, User: user, Groups: []string{}})
 	if err != nil {
 		return result, err
 	}
-	for _, hit := range resp.Hits.Hits {
-		entry := Entry{}
-		err = json.Unmarshal(*hit.Source, &entry)
-		if err != nil {
-			return result, err
-		}
-		result = append(result, entry.Resource)
-	}
-	return
+	return toIdList(resp.Hits), nil
 }
 
 func CheckUser(kind string, resource string, user string, rights string) (err error) {
-	ctx := context.Background()
-	query := elastic.NewBoolQuery().Filter(append(getRightsQuery(rights, user, []string{}), elastic.NewTermQuery("resource", resource))...)
-	resp, err := GetClient().Search().Index(kind).Type(ElasticPermissionType).Version(true).Query(query).Size(1).Do(ctx)
-	if err == nil && resp.Hits.TotalHits == 0 {
+	resp, err := GetStorage().Search(context.Background(), kind, SearchQuery{Rights: rights, User: user, Groups: []string{}, Ids: []string{resource}, Limit: 1})
+	if err == nil && resp.Total == 0 {
 		err = errors.New("access denied")
 	}
 	return
 }
 
 func GetListForGroup(kind string, groups []string, rights string) (result []string, err error) {
-	ctx := context.Background()
-	query := elastic.NewBoolQuery().Filter(getRightsQuery(rights, "", groups)...)
-	resp, err := GetClient().Search().Index(kind).Type(ElasticPermissionType).Version(true).Query(query).Do(ctx)
+	resp, err := GetStorage().Search(context.Background(), kind, SearchQuery{Rights: rights, Groups: groups})
 	if err != nil {
 		return result, err
 	}
-	for _, hit := range resp.Hits.Hits {
-		entry := Entry{}
-		err = json.Unmarshal(*hit.Source, &entry)
-		if err != nil {
-			return result, err
-		}
-		result = append(result, entry.Resource)
-	}
-	return
+	return toIdList(resp.Hits), nil
 }
 
 func CheckGroups(kind string, resource string, groups []string, rights string) (err error) {
-	ctx := context.Background()
-	query := elastic.NewBoolQuery().Filter(append(getRightsQuery(rights, "", groups), elastic.NewTermQuery("resource", resource))...)
-	resp, err := GetClient().Search().Index(kind).Type(ElasticPermissionType).Version(true).Query(query).Size(1).Do(ctx)
-	if err == nil && resp.Hits.TotalHits == 0 {
+	resp, err := GetStorage().Search(context.Background(), kind, SearchQuery{Rights: rights, Groups: groups, Ids: []string{resource}, Limit: 1})
+	if err == nil && resp.Total == 0 {
 		err = errors.New("access denied")
 	}
 	return
@@ -344,117 +199,43 @@ func GetResource(kind string, resource string) (result []ResourceRights, err err
 }
 
 func SearchRightsToAdministrate(kind string, user string, groups []string, query string, limitStr string, offsetStr string) (result []ResourceRights, err error) {
-	limit, err := strconv.Atoi(limitStr)
-	if err != nil {
-		return result, err
-	}
-	offset, err := strconv.Atoi(offsetStr)
+	limit, offset, err := parseLimitOffset(limitStr, offsetStr)
 	if err != nil {
 		return result, err
 	}
-	ctx := context.Background()
-	elastic_query := elastic.NewBoolQuery().Filter(getRightsQuery("a", user, groups)...).Must(elastic.NewMatchQuery("feature_search", query))
-	resp, err := GetClient().Search().Index(kind).Type(ElasticPermissionType).Version(true).Query(elastic_query).Size(limit).From(offset).Do(ctx)
+	resp, _, err := searchWithFallback(context.Background(), kind, SearchQuery{Rights: "a", User: user, Groups: groups, Text: query, Limit: limit, Offset: offset})
 	if err != nil {
 		return result, err
 	}
-	for _, hit := range resp.Hits.Hits {
-		entry := Entry{}
-		err = json.Unmarshal(*hit.Source, &entry)
-		if err != nil {
-			return result, err
-		}
-		result = append(result, entry.ToResourceRights())
-	}
-	return
+	return toResourceRightsList(resp.Hits), nil
 }
 
 func SearchListAll(kind string, query string, user string, groups []string, rights string) (result []map[string]interface{}, err error) {
-	limit := 20
-	offset := 0
-	temp := []map[string]interface{}{}
-	for ok := true; ok; ok = len(temp) > 0 {
-		temp, err = searchList(kind, query, user, groups, rights, limit, offset)
-		if err != nil {
-			return result, err
-		}
-		result = append(result, temp...)
-		offset = offset + limit
-	}
-	return
+	return listAll(kind, SearchQuery{Rights: rights, User: user, Groups: groups, Text: query})
+}
+
+func selectByFieldSelection(field string, value string) *Selection {
+	return &Selection{Condition: ConditionConfig{Feature: "features." + field, Operation: QueryEqualOperation, Value: value}}
 }
 
 func SelectByFieldOrdered(kind string, field string, value string, user string, groups []string, rights string, limitStr string, offsetStr string, orderfeature string, asc bool) (result []map[string]interface{}, err error) {
-	limit, err := strconv.Atoi(limitStr)
-	if err != nil {
-		return result, err
-	}
-	offset, err := strconv.Atoi(offsetStr)
+	limit, offset, err := parseLimitOffset(limitStr, offsetStr)
 	if err != nil {
 		return result, err
 	}
-	ctx := context.Background()
-	query := elastic.NewBoolQuery().Filter(append(getRightsQuery(rights, user, groups), elastic.NewTermQuery("features."+field, value))...)
-	resp, err := GetClient().Search().Index(kind).Type(ElasticPermissionType).Query(query).From(offset).Size(limit).Sort("features."+orderfeature, asc).Do(ctx)
+	resp, err := GetStorage().Search(context.Background(), kind, SearchQuery{Rights: rights, User: user, Groups: groups, Selection: selectByFieldSelection(field, value), Limit: limit, Offset: offset, Sort: sortBy(orderfeature, asc)})
 	if err != nil {
 		return result, err
 	}
-	for _, hit := range resp.Hits.Hits {
-		entry := Entry{}
-		err = json.Unmarshal(*hit.Source, &entry)
-		if err != nil {
-			return result, err
-		}
-		entry.Features["id"] = entry.Resource
-		entry.Features["creator"] = entry.Creator
-		entry.Features["permissions"] = getPermissions(entry, user, groups)
-		result = append(result, entry.Features)
-	}
-	return
+	return toFeatureList(resp.Hits, user, groups), nil
 }
 
 func SelectByFieldAll(kind string, field string, value string, user string, groups []string, rights string) (result []map[string]interface{}, err error) {
-	limit := 20
-	offset := 0
-	temp := []map[string]interface{}{}
-	for ok := true; ok; ok = len(temp) > 0 {
-		temp, err = selectByField(kind, field, value, user, groups, rights, limit, offset)
-		if err != nil {
-			return result, err
-		}
-		result = append(result, temp...)
-		offset = offset + limit
-	}
-	return
-}
-
-func selectByField(kind string, field string, value string, user string, groups []string, rights string, limit int, offset int) (result []map[string]interface{}, err error) {
-	ctx := context.Background()
-	query := elastic.NewBoolQuery().Filter(append(getRightsQuery(rights, user, groups), elastic.NewTermQuery("features."+field, value))...)
-	resp, err := GetClient().Search().Index(kind).Type(ElasticPermissionType).Version(true).Query(query).From(offset).Size(limit).Do(ctx)
-	if err != nil {
-		return result, err
-	}
-	for _, hit := range resp.Hits.Hits {
-		entry := Entry{}
-		err = json.Unmarshal(*hit.Source, &entry)
-		if err != nil {
-			return result, err
-		}
-		entry.Features["id"] = entry.Resource
-		entry.Features["creator"] = entry.Creator
-		entry.Features["permissions"] = getPermissions(entry, user, groups)
-		result = append(result, entry.Features)
-	}
-	return
+	return listAll(kind, SearchQuery{Rights: rights, User: user, Groups: groups, Selection: selectByFieldSelection(field, value)})
 }
 
 func SearchList(kind string, query string, user string, groups []string, rights string, limitStr string, offsetStr string) (result []map[string]interface{}, err error) {
-	limit, err := strconv.Atoi(limitStr)
-	if err != nil {
-		return result, err
-	}
-	offset, err := strconv.Atoi(offsetStr)
+	limit, offset, err := parseLimitOffset(limitStr, offsetStr)
 	if err != nil {
 		return result, err
 	}
@@ -462,53 +243,23 @@ func SearchList(kind string, query string, user string, groups []string, rights
 }
 
 func searchList(kind string, query string, user string, groups []string, rights string, limit int, offset int) (result []map[string]interface{}, err error) {
-	ctx := context.Background()
-	elastic_query := elastic.NewBoolQuery().Filter(getRightsQuery(rights, user, groups)...).Must(elastic.NewMatchQuery("feature_search", query))
-	resp, err := GetClient().Search().Index(kind).Type(ElasticPermissionType).Version(true).Query(elastic_query).From(offset).Size(limit).Do(ctx)
+	resp, _, err := searchWithFallback(context.Background(), kind, SearchQuery{Rights: rights, User: user, Groups: groups, Text: query, Limit: limit, Offset: offset})
 	if err != nil {
 		return result, err
 	}
-	for _, hit := range resp.Hits.Hits {
-		entry := Entry{}
-		err = json.Unmarshal(*hit.Source, &entry)
-		if err != nil {
-			return result, err
-		}
-		entry.Features["id"] = entry.Resource
-		entry.Features["creator"] = entry.Creator
-		entry.Features["permissions"] = getPermissions(entry, user, groups)
-		result = append(result, entry.Features)
-	}
-	return
+	return toFeatureList(resp.Hits, user, groups), nil
 }
 
 func SearchOrderedList(kind string, query string, user string, groups []string, rights string, orderFeature string, asc bool, limitStr string, offsetStr string) (result []map[string]interface{}, err error) {
-	limit, err := strconv.Atoi(limitStr)
-	if err != nil {
-		return result, err
-	}
-	offset, err := strconv.Atoi(offsetStr)
+	limit, offset, err := parseLimitOffset(limitStr, offsetStr)
 	if err != nil {
 		return result, err
 	}
-	ctx := context.Background()
-	elastic_query := elastic.NewBoolQuery().Filter(getRightsQuery(rights, user, groups)...).Must(elastic.NewMatchQuery("feature_search", query))
-	resp, err := GetClient().Search().Index(kind).Type(ElasticPermissionType).Version(true).Query(elastic_query).From(offset).Size(limit).Sort("features."+orderFeature, asc).Do(ctx)
+	resp, _, err := searchWithFallback(context.Background(), kind, SearchQuery{Rights: rights, User: user, Groups: groups, Text: query, Limit: limit, Offset: offset, Sort: sortBy(orderFeature, asc)})
 	if err != nil {
 		return result, err
 	}
-	for _, hit := range resp.Hits.Hits {
-		entry := Entry{}
-		err = json.Unmarshal(*hit.Source, &entry)
-		if err != nil {
-			return result, err
-		}
-		entry.Features["id"] = entry.Resource
-		entry.Features["creator"] = entry.Creator
-		entry.Features["permissions"] = getPermissions(entry, user, groups)
-		result = append(result, entry.Features)
-	}
-	return
+	return toFeatureList(resp.Hits, user, groups), nil
 }
 
 func GetResourceEntry(kind string, resource string) (result Entry, err error) {
@@ -516,14 +267,8 @@ func GetResourceEntry(kind string, resource string) (result Entry, err error) {
 	return
 }
 
-func getResourceEntry(ctx context.Context, kind string, resource string) (result Entry, version int64, err error) {
-	resp, err := GetClient().Get().Index(kind).Type(ElasticPermissionType).Id(resource).Do(ctx)
-	if err != nil {
-		return result, version, err
-	}
-	version = *resp.Version
-	err = json.Unmarshal(*resp.Source, &result)
-	return
+func getResourceEntry(ctx context.Context, kind string, resource string) (result Entry, version Version, err error) {
+	return GetStorage().Get(ctx, kind, resource)
 }
 
 func anyMatch(aList []string, bList []string) bool {
@@ -547,60 +292,26 @@ func getPermissions(entry Entry, user string, groups []string) (result map[strin
 	return
 }
 
-func SearchOrderedListWithSelection(kind string, query string, user string, groups []string, rights string, orderFeature string, asc bool, limitStr string, offsetStr string, selection elastic.Query) (result []map[string]interface{}, err error) {
-	limit, err := strconv.Atoi(limitStr)
+func SearchOrderedListWithSelection(kind string, query string, user string, groups []string, rights string, orderFeature string, asc bool, limitStr string, offsetStr string, selection Selection) (result []map[string]interface{}, err error) {
+	limit, offset, err := parseLimitOffset(limitStr, offsetStr)
 	if err != nil {
 		return result, err
 	}
-	offset, err := strconv.Atoi(offsetStr)
+	resp, _, err := searchWithFallback(context.Background(), kind, SearchQuery{Rights: rights, User: user, Groups: groups, Text: query, Selection: &selection, Limit: limit, Offset: offset, Sort: sortBy(orderFeature, asc)})
 	if err != nil {
 		return result, err
 	}
-	ctx := context.Background()
-	elastic_query := elastic.NewBoolQuery().Filter(getRightsQuery(rights, user, groups)...).Must(elastic.NewMatchQuery("feature_search", query)).Filter(selection)
-	resp, err := GetClient().Search().Index(kind).Type(ElasticPermissionType).Version(true).Query(elastic_query).From(offset).Size(limit).Sort("features."+orderFeature, asc).Do(ctx)
-	if err != nil {
-		return result, err
-	}
-	for _, hit := range resp.Hits.Hits {
-		entry := Entry{}
-		err = json.Unmarshal(*hit.Source, &entry)
-		if err != nil {
-			return result, err
-		}
-		entry.Features["id"] = entry.Resource
-		entry.Features["creator"] = entry.Creator
-		entry.Features["permissions"] = getPermissions(entry, user, groups)
-		result = append(result, entry.Features)
-	}
-	return
+	return toFeatureList(resp.Hits, user, groups), nil
 }
 
-func GetOrderedListForUserOrGroupWithSelection(kind string, user string, groups []string, rights string, limitStr string, offsetStr string, orderfeature string, asc bool, selection elastic.Query) (result []map[string]interface{}, err error) {
-	limit, err := strconv.Atoi(limitStr)
+func GetOrderedListForUserOrGroupWithSelection(kind string, user string, groups []string, rights string, limitStr string, offsetStr string, orderfeature string, asc bool, selection Selection) (result []map[string]interface{}, err error) {
+	limit, offset, err := parseLimitOffset(limitStr, offsetStr)
 	if err != nil {
 		return result, err
 	}
-	offset, err := strconv.Atoi(offsetStr)
+	resp, err := GetStorage().Search(context.Background(), kind, SearchQuery{Rights: rights, User: user, Groups: groups, Selection: &selection, Limit: limit, Offset: offset, Sort: sortBy(orderfeature, asc)})
 	if err != nil {
 		return result, err
 	}
-	ctx := context.Background()
-	query := elastic.NewBoolQuery().Filter(getRightsQuery(rights, user, groups)...).Filter(selection)
-	resp, err := GetClient().Search().Index(kind).Type(ElasticPermissionType).Version(true).Query(query).Size(limit).From(offset).Sort("features."+orderfeature, asc).Do(ctx)
-	if err != nil {
-		return result, err
-	}
-	for _, hit := range resp.Hits.Hits {
-		entry := Entry{}
-		err = json.Unmarshal(*hit.Source, &entry)
-		if err != nil {
-			return result, err
-		}
-		entry.Features["id"] = entry.Resource
-		entry.Features["creator"] = entry.Creator
-		entry.Features["permissions"] = getPermissions(entry, user, groups)
-		result = append(result, entry.Features)
-	}
-	return
+	return toFeatureList(resp.Hits, user, groups), nil
 }
@@ -0,0 +1,329 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// QueryStringError is a syntax or validation error of a query string; Position is the 1-based character position
+type QueryStringError struct {
+	Position int
+	Message  string
+}
+
+func (this QueryStringError) Error() string {
+	return fmt.Sprintf("position %d: %s", this.Position, this.Message)
+}
+
+// ParseQueryString compiles a filter like `vendor:"ACME" AND tag:(lamp OR switch) AND NOT maintenance:broken` into a Selection.
+//
+//	expression := and {"OR" and}
+//	and        := unary {"AND" unary}
+//	unary      := "NOT" unary | "(" expression ")" | feature ":" [comparison] values
+//	values     := value | "(" value {("AND"|"OR") value} ")"
+//	comparison := ">" | ">=" | "<" | "<="
+//
+// Values are words or double quoted strings; `*` matches any existing value and a trailing `*` a prefix.
+// Feature names have to be features of the resource kind.
+func ParseQueryString(kind string, query string) (result Selection, err error) {
+	resource, ok := Config.Resources[kind]
+	if !ok {
+		return result, QueryStringError{Position: 1, Message: "unknown resource kind " + kind}
+	}
+	tokens, err := lexQueryString(query)
+	if err != nil {
+		return result, err
+	}
+	parser := &queryStringParser{kind: kind, resource: resource, tokens: tokens}
+	result, err = parser.expression()
+	if err != nil {
+		return result, err
+	}
+	if token := parser.peek(); token.kind != queryStringEnd {
+		return result, parser.errorAt(token, "expected AND, OR or end of query but found "+token.String())
+	}
+	return result, nil
+}
+
+type queryStringTokenKind int
+
+const (
+	queryStringEnd queryStringTokenKind = iota
+	queryStringWord
+	queryStringQuoted
+	queryStringOpen
+	queryStringClose
+	queryStringColon
+	queryStringComparison
+)
+
+type queryStringToken struct {
+	kind     queryStringTokenKind
+	value    string
+	position int
+}
+
+func (this queryStringToken) String() string {
+	switch this.kind {
+	case queryStringEnd:
+		return "end of query"
+	case queryStringQuoted:
+		return strconv.Quote(this.value)
+	}
+	return "'" + this.value + "'"
+}
+
+func (this queryStringToken) keyword(keyword string) bool {
+	return this.kind == queryStringWord && this.value == keyword
+}
+
+func lexQueryString(query string) (result []queryStringToken, err error) {
+	runes := []rune(query)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		position := i + 1
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			result = append(result, queryStringToken{kind: queryStringOpen, value: "(", position: position})
+			i++
+		case r == ')':
+			result = append(result, queryStringToken{kind: queryStringClose, value: ")", position: position})
+			i++
+		case r == ':':
+			result = append(result, queryStringToken{kind: queryStringColon, value: ":", position: position})
+			i++
+		case r == '<' || r == '>':
+			value := string(r)
+			i++
+			if i < len(runes) && runes[i] == '=' {
+				value += "="
+				i++
+			}
+			result = append(result, queryStringToken{kind: queryStringComparison, value: value, position: position})
+		case r == '"':
+			value := []rune{}
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value = append(value, runes[i])
+			}
+			if i >= len(runes) {
+				return result, QueryStringError{Position: position, Message: "unterminated quoted string"}
+			}
+			i++
+			result = append(result, queryStringToken{kind: queryStringQuoted, value: string(value), position: position})
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune("():\"<>", runes[i]) {
+				i++
+			}
+			result = append(result, queryStringToken{kind: queryStringWord, value: string(runes[start:i]), position: position})
+		}
+	}
+	return append(result, queryStringToken{kind: queryStringEnd, position: len(runes) + 1}), nil
+}
+
+type queryStringParser struct {
+	kind     string
+	resource ResourceConfig
+	tokens   []queryStringToken
+	index    int
+}
+
+func (this *queryStringParser) peek() queryStringToken {
+	return this.tokens[this.index]
+}
+
+func (this *queryStringParser) next() queryStringToken {
+	token := this.tokens[this.index]
+	if token.kind != queryStringEnd {
+		this.index++
+	}
+	return token
+}
+
+func (this *queryStringParser) errorAt(token queryStringToken, message string) error {
+	return QueryStringError{Position: token.position, Message: message}
+}
+
+func (this *queryStringParser) expression() (result Selection, err error) {
+	return this.binary("OR", this.and, func(elements []Selection) Selection { return Selection{Or: elements} })
+}
+
+func (this *queryStringParser) and() (result Selection, err error) {
+	return this.binary("AND", this.unary, func(elements []Selection) Selection { return Selection{And: elements} })
+}
+
+// binary parses operands separated by the keyword and combines more than one operand with combine
+func (this *queryStringParser) binary(keyword string, operand func() (Selection, error), combine func([]Selection) Selection) (result Selection, err error) {
+	element, err := operand()
+	if err != nil {
+		return result, err
+	}
+	elements := []Selection{element}
+	for this.peek().keyword(keyword) {
+		this.next()
+		element, err = operand()
+		if err != nil {
+			return result, err
+		}
+		elements = append(elements, element)
+	}
+	if len(elements) == 1 {
+		return elements[0], nil
+	}
+	return combine(elements), nil
+}
+
+func (this *queryStringParser) unary() (result Selection, err error) {
+	token := this.next()
+	switch {
+	case token.keyword("NOT"):
+		not, err := this.unary()
+		if err != nil {
+			return result, err
+		}
+		return Selection{Not: &not}, nil
+	case token.kind == queryStringOpen:
+		result, err = this.expression()
+		if err != nil {
+			return result, err
+		}
+		if closing := this.next(); closing.kind != queryStringClose {
+			return result, this.errorAt(closing, "expected ')' but found "+closing.String())
+		}
+		return result, nil
+	case token.kind == queryStringWord && !token.keyword("AND") && !token.keyword("OR"):
+		return this.condition(token)
+	}
+	return result, this.errorAt(token, "expected feature, NOT or '(' but found "+token.String())
+}
+
+func (this *queryStringParser) condition(feature queryStringToken) (result Selection, err error) {
+	if !this.knownFeature(feature.value) {
+		return result, this.errorAt(feature, "unknown feature "+feature.value+" of "+this.kind)
+	}
+	if colon := this.next(); colon.kind != queryStringColon {
+		return result, this.errorAt(colon, "expected ':' after feature "+feature.value+" but found "+colon.String())
+	}
+	if comparison := this.peek(); comparison.kind == queryStringComparison {
+		this.next()
+		value := this.next()
+		if value.kind != queryStringWord && value.kind != queryStringQuoted {
+			return result, this.errorAt(value, "expected value after "+comparison.value+" but found "+value.String())
+		}
+		return this.compile(feature, QueryOperationType(comparison.value), value)
+	}
+	return this.values(feature)
+}
+
+// values parses a single value or a group of values of one feature, like tag:(lamp OR switch)
+func (this *queryStringParser) values(feature queryStringToken) (result Selection, err error) {
+	value := this.next()
+	switch {
+	case value.kind == queryStringOpen:
+		result, err = this.valueGroup(feature, "OR")
+		if err != nil {
+			return result, err
+		}
+		if closing := this.next(); closing.kind != queryStringClose {
+			return result, this.errorAt(closing, "expected ')' but found "+closing.String())
+		}
+		return result, nil
+	case value.keyword("NOT"):
+		not, err := this.values(feature)
+		if err != nil {
+			return result, err
+		}
+		return Selection{Not: &not}, nil
+	case value.kind == queryStringQuoted:
+		return this.compile(feature, QueryEqualOperation, value)
+	case value.kind == queryStringWord && !value.keyword("AND") && !value.keyword("OR"):
+		switch {
+		case value.value == "*":
+			return this.compile(feature, QueryExistsOperation, value)
+		case strings.HasSuffix(value.value, "*"):
+			value.value = strings.TrimSuffix(value.value, "*")
+			return this.compile(feature, QueryPrefixOperation, value)
+		}
+		return this.compile(feature, QueryEqualOperation, value)
+	}
+	return result, this.errorAt(value, "expected value of "+feature.value+" but found "+value.String())
+}
+
+func (this *queryStringParser) valueGroup(feature queryStringToken, keyword string) (result Selection, err error) {
+	operand := func() (Selection, error) { return this.values(feature) }
+	combine := func(elements []Selection) Selection { return Selection{Or: elements} }
+	if keyword == "OR" {
+		operand = func() (Selection, error) { return this.valueGroup(feature, "AND") }
+	} else {
+		combine = func(elements []Selection) Selection { return Selection{And: elements} }
+	}
+	return this.binary(keyword, operand, combine)
+}
+
+func (this *queryStringParser) knownFeature(feature string) bool {
+	name := strings.SplitN(feature, ".", 2)[0]
+	for _, element := range this.resource.Features {
+		if element.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// compile creates the condition with a value typed by the ElasticMapping of the feature and validates it
+func (this *queryStringParser) compile(feature queryStringToken, operation QueryOperationType, value queryStringToken) (result Selection, err error) {
+	condition := ConditionConfig{Feature: "features." + feature.value, Operation: operation}
+	if operation != QueryExistsOperation {
+		condition.Value, err = this.typedValue(condition.Feature, value)
+		if err != nil {
+			return result, err
+		}
+	}
+	if err = condition.Validate(this.kind); err != nil {
+		return result, this.errorAt(value, err.Error())
+	}
+	return Selection{Condition: condition}, nil
+}
+
+func (this *queryStringParser) typedValue(field string, value queryStringToken) (interface{}, error) {
+	mappingType, _ := fieldType(this.kind, field)
+	switch {
+	case numericMappingTypes[mappingType]:
+		number, err := strconv.ParseFloat(value.value, 64)
+		if err != nil {
+			return nil, this.errorAt(value, "expected number for "+strings.TrimPrefix(field, "features.")+" but found "+value.String())
+		}
+		return number, nil
+	case mappingType == "boolean":
+		boolean, err := strconv.ParseBool(value.value)
+		if err != nil {
+			return nil, this.errorAt(value, "expected true or false for "+strings.TrimPrefix(field, "features.")+" but found "+value.String())
+		}
+		return boolean, nil
+	}
+	return value.value, nil
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"strings"
+)
+
+const allRights = "arwx"
+
+// GroupRightsReconciliation describes which group rights are added to or removed from every entry of a kind
+type GroupRightsReconciliation struct {
+	Add      map[string]string `json:"add"`
+	Remove   map[string]string `json:"remove"`
+	Affected int               `json:"affected"`
+}
+
+// ReconcileInitialGroupRights compares the InitialGroupRights applied by the last run (stored in the storage)
+// with the configured ones and adds or removes the changed group rights on all entries.
+// With dryRun only the number of affected entries per kind is computed.
+func ReconcileInitialGroupRights(dryRun bool) (report map[string]GroupRightsReconciliation, err error) {
+	previous, err := loadInitialGroupRightsState()
+	if err != nil {
+		return report, err
+	}
+	ctx := context.Background()
+	report = map[string]GroupRightsReconciliation{}
+	for kind, resourceConfig := range Config.Resources {
+		reconciliation := diffGroupRights(previous[kind], resourceConfig.InitialGroupRights)
+		if len(reconciliation.Add) > 0 || len(reconciliation.Remove) > 0 {
+			reconciliation.Affected, err = updateAllEntries(ctx, kind, dryRun, reconciliation.apply)
+			if err != nil {
+				log.Println("ERROR: unable to reconcile initial group rights; ", kind, err)
+				return report, err
+			}
+		}
+		report[kind] = reconciliation
+		log.Println("reconcile initial group rights of", kind, "add:", reconciliation.Add, "remove:", reconciliation.Remove, "affected entries:", reconciliation.Affected, "dry-run:", dryRun)
+	}
+	if dryRun {
+		return report, nil
+	}
+	return report, saveInitialGroupRightsState()
+}
+
+func diffGroupRights(previous map[string]string, current map[string]string) (result GroupRightsReconciliation) {
+	result.Add = map[string]string{}
+	result.Remove = map[string]string{}
+	for group, rights := range current {
+		if added := rightsWithout(rights, previous[group]); added != "" {
+			result.Add[group] = added
+		}
+	}
+	for group, rights := range previous {
+		if removed := rightsWithout(rights, current[group]); removed != "" {
+			result.Remove[group] = removed
+		}
+	}
+	return
+}
+
+// rightsWithout returns the rights of a which are not in b
+func rightsWithout(a string, b string) (result string) {
+	for _, right := range allRights {
+		if strings.ContainsRune(a, right) && !strings.ContainsRune(b, right) {
+			result = result + string(right)
+		}
+	}
+	return
+}
+
+// apply adds and removes the group rights while keeping all other rights of the group; reports if the entry has been changed
+func (this GroupRightsReconciliation) apply(entry *Entry) bool {
+	before := entry.ToResourceRights().GroupRights
+	groups := map[string]bool{}
+	for group := range this.Add {
+		groups[group] = true
+	}
+	for group := range this.Remove {
+		groups[group] = true
+	}
+	for group := range groups {
+		rights := rightsWithout(rightToString(before[group]), this.Remove[group])
+		rights = rights + rightsWithout(this.Add[group], rights)
+		entry.removeGroupRights(group)
+		entry.addGroupRights(group, rights)
+	}
+	return !reflect.DeepEqual(before, entry.ToResourceRights().GroupRights)
+}
+
+func rightToString(right Right) (result string) {
+	if right.Administrate {
+		result = result + "a"
+	}
+	if right.Read {
+		result = result + "r"
+	}
+	if right.Write {
+		result = result + "w"
+	}
+	if right.Execute {
+		result = result + "x"
+	}
+	return
+}
+
+// initialGroupRightsStateKey is the key of the InitialGroupRights applied by the last update in the service state of the storage
+const initialGroupRightsStateKey = "initial_group_rights"
+
+// loadInitialGroupRightsState returns the InitialGroupRights per kind applied by the last update from the storage;
+// a missing state is treated as empty
+func loadInitialGroupRightsState() (result map[string]map[string]string, err error) {
+	result = map[string]map[string]string{}
+	err = GetStorage().GetState(context.Background(), initialGroupRightsStateKey, &result)
+	if err == ErrNotFound {
+		log.Println("WARNING: no previous initial group rights stored; only additions can be reconciled")
+		return result, nil
+	}
+	return result, err
+}
+
+// saveInitialGroupRightsState stores the configured InitialGroupRights as reference for the next reconciliation
+func saveInitialGroupRightsState() error {
+	state := map[string]map[string]string{}
+	for kind, resourceConfig := range Config.Resources {
+		state[kind] = resourceConfig.InitialGroupRights
+	}
+	return GetStorage().PutState(context.Background(), initialGroupRightsStateKey, state)
+}
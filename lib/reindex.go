@@ -0,0 +1,419 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/olivere/elastic"
+)
+
+// reindexPollInterval is a variable to keep tests fast
+var reindexPollInterval = 2 * time.Second
+
+// defaultReindexTimeout limits each reindex of a migration if Config.ElasticReindexTimeout is not set
+const defaultReindexTimeout = time.Hour
+
+func reindexTimeout() time.Duration {
+	if Config.ElasticReindexTimeout > 0 {
+		return time.Duration(Config.ElasticReindexTimeout) * time.Second
+	}
+	return defaultReindexTimeout
+}
+
+type reindexTask struct {
+	Completed bool `json:"completed"`
+	Task      struct {
+		Status struct {
+			Total            int64 `json:"total"`
+			Created          int64 `json:"created"`
+			Updated          int64 `json:"updated"`
+			VersionConflicts int64 `json:"version_conflicts"`
+		} `json:"status"`
+	} `json:"task"`
+	Response struct {
+		Failures []interface{} `json:"failures"`
+	} `json:"response"`
+	Error interface{} `json:"error"`
+}
+
+// MigrateMappings moves every resource kind whose index mapping differs from the configured mapping to a new index version
+func MigrateMappings() (err error) {
+	ctx := context.Background()
+	for kind := range Config.Resources {
+		_, err = migrateMapping(ctx, GetClient(), kind)
+		if err != nil {
+			log.Println("ERROR: mapping migration of", kind, "failed:", err)
+			return err
+		}
+	}
+	return
+}
+
+// migrateMapping creates <kind>_v<n+1> with the current mapping, copies all entries and points the alias <kind> to the new index
+func migrateMapping(ctx context.Context, client *elastic.Client, kind string) (migrated bool, err error) {
+	current, changed, err := mappingChanged(ctx, client, kind)
+	if err != nil || !changed {
+		return false, err
+	}
+	version, err := indexVersion(kind, current)
+	if err != nil {
+		return false, err
+	}
+	next := kind + "_v" + strconv.Itoa(version+1)
+	log.Println("INFO: migrate mapping of", kind, "from", current, "to", next)
+	mapping, err := createMapping(kind)
+	if err != nil {
+		return false, err
+	}
+	err = createIndexVersion(ctx, client, next, mapping)
+	if err != nil {
+		return false, err
+	}
+	legacy := false
+	if elasticTypeless {
+		legacy, err = createdWithMappingTypes(ctx, client, current)
+		if err != nil {
+			return false, err
+		}
+	}
+	err = reindex(ctx, client, current, next, legacy, false)
+	if err != nil {
+		return false, err
+	}
+	//nothing else writes to the new index before the alias swap
+	copied, err := entryVersions(ctx, client, next)
+	if err != nil {
+		return false, err
+	}
+	//the old index is read-only until the alias points to the new one, so the catch-up copies the final state of every entry
+	//and can not overwrite a newer write to the new index; writes in between fail and are retried by the event transport
+	err = setWriteBlock(ctx, client, current, true)
+	if err != nil {
+		return false, err
+	}
+	deleted := 0
+	//entries written to the old index while the first reindex was running
+	err = reindex(ctx, client, current, next, legacy, true)
+	if err == nil {
+		deleted, err = deleteRemovedEntries(ctx, client, current, next, copied)
+	}
+	if err == nil {
+		_, err = client.Alias().Remove(current, kind).Add(next, kind).Do(ctx)
+	}
+	if err != nil {
+		if unblockErr := setWriteBlock(context.Background(), client, current, false); unblockErr != nil {
+			log.Println("ERROR: unable to remove the write block of", current, unblockErr)
+		}
+		return false, err
+	}
+	log.Println("INFO: alias", kind, "now points to", next)
+	log.Println("INFO: deleted", deleted, "entries of", next, "which have been deleted from", current, "during the migration")
+	log.Println("INFO: mapping migration of", kind, "finished; previous index", current, "is kept read-only and may be deleted")
+	return true, nil
+}
+
+// setWriteBlock sets or removes index.blocks.write of the index
+func setWriteBlock(ctx context.Context, client *elastic.Client, index string, blocked bool) error {
+	_, err := client.IndexPutSettings(index).BodyJson(map[string]interface{}{"index.blocks.write": blocked}).Do(ctx)
+	return err
+}
+
+// mappingChanged compares the mapping of the index behind the kind alias with createMapping(); fields added by dynamic mapping are ignored
+func mappingChanged(ctx context.Context, client *elastic.Client, kind string) (index string, changed bool, err error) {
+	live, err := client.GetMapping().Index(kind).Do(ctx)
+	if err != nil {
+		return index, changed, err
+	}
+	if len(live) != 1 {
+		return index, changed, errors.New("expected exactly one index for " + kind)
+	}
+	for name := range live {
+		index = name
+	}
+	if index == kind {
+		return index, changed, errors.New("index " + kind + " is not an alias; unable to migrate the mapping without downtime")
+	}
+	if elasticTypeless {
+		legacy, err := createdWithMappingTypes(ctx, client, index)
+		if err != nil {
+			return index, changed, err
+		}
+		if legacy {
+			log.Println("WARNING:", index, "was created by elasticsearch 6 and has to be migrated to a typeless index")
+			return index, true, nil
+		}
+	}
+	mapping, err := createMapping(kind)
+	if err != nil {
+		return index, changed, err
+	}
+	expected, err := normalizeMapping(mapping["mappings"])
+	if err != nil {
+		return index, changed, err
+	}
+	liveIndex, _ := live[index].(map[string]interface{})
+	changed = !mappingContains(liveIndex["mappings"], expected)
+	if changed {
+		log.Println("WARNING: mapping of", kind, "(", index, ") differs from the configured mapping")
+		return index, changed, nil
+	}
+	changed, err = analysisChanged(ctx, client, index, mapping["settings"])
+	if changed {
+		log.Println("WARNING: analysis settings of", kind, "(", index, ") differ from the configured settings")
+	}
+	return index, changed, err
+}
+
+// analysisChanged compares the analysis settings (analyzers, normalizers and filters) of the index with the ones of createMapping()
+func analysisChanged(ctx context.Context, client *elastic.Client, index string, settings interface{}) (bool, error) {
+	live, err := client.IndexGetSettings(index).Do(ctx)
+	if err != nil {
+		return false, err
+	}
+	expected, err := normalizeMapping(settings)
+	if err != nil {
+		return false, err
+	}
+	liveIndex := map[string]interface{}{}
+	if indexSettings, ok := live[index]; ok {
+		liveIndex, _ = indexSettings.Settings["index"].(map[string]interface{})
+	}
+	expectedSettings, _ := expected.(map[string]interface{})
+	return !mappingContains(liveIndex["analysis"], expectedSettings["analysis"]), nil
+}
+
+func createdWithMappingTypes(ctx context.Context, client *elastic.Client, index string) (bool, error) {
+	settings, err := client.IndexGetSettings(index).Name("index.version.created").Do(ctx)
+	if err != nil {
+		return false, err
+	}
+	created := ""
+	if indexSettings, ok := settings[index]; ok {
+		indexSetting, _ := indexSettings.Settings["index"].(map[string]interface{})
+		versionSetting, _ := indexSetting["version"].(map[string]interface{})
+		created, _ = versionSetting["created"].(string)
+	}
+	version, err := strconv.Atoi(created)
+	if err != nil {
+		return false, errors.New("unable to read index.version.created of " + index)
+	}
+	return version < 7000000, nil
+}
+
+func normalizeMapping(mapping interface{}) (result interface{}, err error) {
+	temp, err := json.Marshal(mapping)
+	if err != nil {
+		return result, err
+	}
+	err = json.Unmarshal(temp, &result)
+	return
+}
+
+func mappingContains(live interface{}, expected interface{}) bool {
+	switch expectedValue := expected.(type) {
+	case map[string]interface{}:
+		liveMap, ok := live.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for key, value := range expectedValue {
+			if !mappingContains(liveMap[key], value) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		liveList, ok := live.([]interface{})
+		if !ok || len(liveList) != len(expectedValue) {
+			return false
+		}
+		for i, value := range expectedValue {
+			if !mappingContains(liveList[i], value) {
+				return false
+			}
+		}
+		return true
+	default:
+		//elasticsearch returns a single copy_to target as list
+		if liveList, ok := live.([]interface{}); ok && len(liveList) == 1 {
+			live = liveList[0]
+		}
+		return live != nil && fmt.Sprint(live) == fmt.Sprint(expected)
+	}
+}
+
+func indexVersion(kind string, index string) (int, error) {
+	if !strings.HasPrefix(index, kind+"_v") {
+		return 0, errors.New("unexpected index name " + index + " for " + kind)
+	}
+	return strconv.Atoi(strings.TrimPrefix(index, kind+"_v"))
+}
+
+// reindex copies all entries with external versioning, so that only newer entries overwrite existing ones in catchUp mode;
+// entries of a legacy source are stored without their "resource" mapping type.
+// The reindex task is cancelled if it takes longer than reindexTimeout() or ctx is done.
+func reindex(ctx context.Context, client *elastic.Client, source string, target string, legacy bool, catchUp bool) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, reindexTimeout())
+	defer cancel()
+	destination := elastic.NewReindexDestination().Index(target).VersionType("external")
+	if legacy {
+		destination = destination.Type(documentType())
+	}
+	service := client.Reindex().Source(elastic.NewReindexSource().Index(source)).Destination(destination)
+	if catchUp {
+		service = service.ProceedOnVersionConflict()
+	}
+	task, err := service.DoAsync(ctx)
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			cancelReindex(client, task.TaskId)
+			return fmt.Errorf("reindex %v -> %v aborted: %v", source, target, ctx.Err())
+		case <-time.After(reindexPollInterval):
+		}
+		resp, err := client.PerformRequest(ctx, elastic.PerformRequestOptions{Method: "GET", Path: "/_tasks/" + task.TaskId})
+		if err != nil {
+			return err
+		}
+		status := reindexTask{}
+		err = json.Unmarshal(resp.Body, &status)
+		if err != nil {
+			return err
+		}
+		progress := status.Task.Status
+		log.Println("INFO: reindex", source, "->", target, progress.Created+progress.Updated+progress.VersionConflicts, "/", progress.Total)
+		if status.Error != nil {
+			return fmt.Errorf("reindex %v -> %v failed: %v", source, target, status.Error)
+		}
+		if len(status.Response.Failures) > 0 {
+			return fmt.Errorf("reindex %v -> %v failed: %v", source, target, status.Response.Failures)
+		}
+		if status.Completed {
+			return nil
+		}
+	}
+}
+
+func cancelReindex(client *elastic.Client, taskId string) {
+	_, err := client.TasksCancel().TaskId(taskId).Do(context.Background())
+	if err != nil {
+		log.Println("ERROR: unable to cancel reindex task", taskId, err)
+	}
+}
+
+// entryVersions returns the version of every entry of the index
+func entryVersions(ctx context.Context, client *elastic.Client, index string) (result map[string]Version, err error) {
+	result = map[string]Version{}
+	err = scrollIndex(ctx, client, index, func(hits []*elastic.SearchHit) error {
+		for _, hit := range hits {
+			result[hit.Id] = elasticVersion(hit.Version, hit.SeqNo, hit.PrimaryTerm)
+		}
+		return nil
+	})
+	return
+}
+
+// deleteRemovedEntries deletes the copied entries which no longer exist in source from target;
+// entries written to target since they have been copied fail the version check and are kept
+func deleteRemovedEntries(ctx context.Context, client *elastic.Client, source string, target string, copied map[string]Version) (deleted int, err error) {
+	err = scrollIndex(ctx, client, source, func(hits []*elastic.SearchHit) error {
+		for _, hit := range hits {
+			delete(copied, hit.Id)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	bulk := client.Bulk().Index(target)
+	flush := func() error {
+		if bulk.NumberOfActions() == 0 {
+			return nil
+		}
+		resp, err := bulk.Do(ctx)
+		if err != nil {
+			return err
+		}
+		deleted = deleted + len(resp.Succeeded())
+		for _, item := range resp.Failed() {
+			if item.Status == http.StatusConflict || item.Status == http.StatusNotFound {
+				continue
+			}
+			reason := ""
+			if item.Error != nil {
+				reason = item.Error.Reason
+			}
+			return fmt.Errorf("delete of %v %v failed: %v", target, item.Id, reason)
+		}
+		return nil
+	}
+	for id, version := range copied {
+		request := elastic.NewBulkDeleteRequest().Id(id)
+		if !elasticTypeless {
+			request = request.Type(ElasticPermissionType)
+		}
+		switch {
+		case version.PrimaryTerm > 0:
+			request = request.IfSeqNo(version.Number).IfPrimaryTerm(version.PrimaryTerm)
+		case version.IsSet():
+			request = request.Version(version.Number)
+		}
+		bulk = bulk.Add(request)
+		if bulk.NumberOfActions() >= scrollBatchSize() {
+			if err = flush(); err != nil {
+				return
+			}
+		}
+	}
+	err = flush()
+	return
+}
+
+// scrollIndex passes the ids and versions of all documents of the index in batches to handler
+func scrollIndex(ctx context.Context, client *elastic.Client, index string, handler func(hits []*elastic.SearchHit) error) error {
+	source := elastic.NewSearchSource().Query(elastic.NewMatchAllQuery()).FetchSource(false).Version(true)
+	if elasticTypeless {
+		source = source.SeqNoAndPrimaryTerm(true)
+	}
+	scroll := client.Scroll(index).SearchSource(source).Size(scrollBatchSize())
+	defer scroll.Clear(context.Background())
+	for {
+		resp, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = handler(resp.Hits.Hits); err != nil {
+			return err
+		}
+	}
+}
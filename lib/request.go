@@ -0,0 +1,255 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// QueryRequest is the body of POST /v2/query/:resource_kind and describes a rights filtered list or search
+type QueryRequest struct {
+	Text          string     `json:"text"`
+	TextOptions              //mode, fuzziness and highlight of the text
+	Rights        string     `json:"rights"` //default "r"
+	Selection     *Selection `json:"selection"`
+	Ids           []string   `json:"ids"` //nil matches every resource, an empty list matches none
+	Sort          []SortKey  `json:"sort"`
+	Limit         int        `json:"limit"` //default 10
+	Offset        int        `json:"offset"`
+	Cursor        string     `json:"cursor"` //FeaturePage.Next of the previous page; replaces the offset
+	Fields        []string   `json:"fields"` //features to return; "*" returns all; id, creator and permissions are always returned
+	ExcludeFields []string   `json:"exclude_fields"`
+}
+
+func (this QueryRequest) Validate(kind string) error {
+	if _, ok := Config.Resources[kind]; !ok {
+		return errors.New("unknown resource kind " + kind)
+	}
+	if this.Rights != "" {
+		if err := validateRights(this.Rights); err != nil {
+			return err
+		}
+	}
+	if this.Limit < 0 || this.Offset < 0 {
+		return errors.New("limit and offset must not be negative")
+	}
+	if err := this.TextOptions.Validate(); err != nil {
+		return err
+	}
+	for _, field := range append(append([]string{}, this.Fields...), this.ExcludeFields...) {
+		if field == "" {
+			return errors.New("empty field in projection")
+		}
+	}
+	for _, key := range this.Sort {
+		if key.Feature == "" {
+			return errors.New("missing sort feature")
+		}
+		if key.Direction != "" && key.Direction != "asc" && key.Direction != "desc" {
+			return errors.New("unknown sort direction " + key.Direction)
+		}
+	}
+	if this.Selection != nil {
+		return this.Selection.Validate(kind)
+	}
+	return nil
+}
+
+// validateRights rejects empty rights and letters which are not in allRights, because they would not filter by rights
+func validateRights(rights string) error {
+	if rights == "" {
+		return errors.New("missing rights")
+	}
+	for _, right := range rights {
+		if !strings.ContainsRune(allRights, right) {
+			return errors.New("unknown right " + string(right))
+		}
+	}
+	return nil
+}
+
+func (this QueryRequest) searchQuery(kind string, user string, groups []string) SearchQuery {
+	rights := this.Rights
+	if rights == "" {
+		rights = "r"
+	}
+	return SearchQuery{
+		Rights:      rights,
+		User:        user,
+		Groups:      groups,
+		Ids:         this.Ids,
+		Text:        this.Text,
+		TextOptions: this.TextOptions,
+		Selection:   this.Selection,
+		Sort:        this.Sort,
+		Limit:       this.Limit,
+		Offset:      this.Offset,
+		Projection:  this.projection(kind),
+	}
+}
+
+// projection returns the DefaultProjection of the kind if the request selects no fields
+func (this QueryRequest) projection(kind string) *Projection {
+	if this.Fields == nil && this.ExcludeFields == nil {
+		return Config.Resources[kind].DefaultProjection
+	}
+	result := &Projection{Excludes: this.ExcludeFields}
+	for _, field := range this.Fields {
+		if field == "*" {
+			result.Includes = nil
+			break
+		}
+		result.Includes = append(result.Includes, field)
+	}
+	return result
+}
+
+// queryRequestFromUrl reads the query parameters of GET /v2/query/:resource_kind; q is compiled by ParseQueryString,
+// sort and fields are comma separated lists and a sort feature prefixed with "-" is ordered descending
+func queryRequestFromUrl(kind string, values url.Values) (request QueryRequest, err error) {
+	request.Text = values.Get("text")
+	request.TextOptions = textOptionsFromUrl(values)
+	request.Rights = values.Get("rights")
+	request.Cursor = values.Get("cursor")
+	if q := values.Get("q"); q != "" {
+		selection, err := ParseQueryString(kind, q)
+		if err != nil {
+			return request, err
+		}
+		request.Selection = &selection
+	}
+	if limit := values.Get("limit"); limit != "" {
+		if request.Limit, err = strconv.Atoi(limit); err != nil {
+			return request, errors.New("invalid limit " + limit)
+		}
+	}
+	if offset := values.Get("offset"); offset != "" {
+		if request.Offset, err = strconv.Atoi(offset); err != nil {
+			return request, errors.New("invalid offset " + offset)
+		}
+	}
+	for _, feature := range splitList(values.Get("sort")) {
+		if strings.HasPrefix(feature, "-") {
+			request.Sort = append(request.Sort, SortKey{Feature: strings.TrimPrefix(feature, "-"), Direction: "desc"})
+		} else {
+			request.Sort = append(request.Sort, SortKey{Feature: feature, Direction: "asc"})
+		}
+	}
+	request.Fields = splitList(values.Get("fields"))
+	return request, nil
+}
+
+func splitList(list string) (result []string) {
+	for _, element := range strings.Split(list, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			result = append(result, element)
+		}
+	}
+	return
+}
+
+// Query returns one page of the features the user or groups have the requested rights for
+func Query(kind string, user string, groups []string, request QueryRequest) (page FeaturePage, err error) {
+	return ListPage(kind, request.searchQuery(kind, user, groups), request.Cursor)
+}
+
+// QueryAll returns the features of all pages of the request; Limit, Offset and Cursor are ignored
+func QueryAll(kind string, user string, groups []string, request QueryRequest) (result []map[string]interface{}, err error) {
+	return listAll(kind, request.searchQuery(kind, user, groups))
+}
+
+// KindSearchRequest is the body of POST /v2/search and searches several resource kinds ranked together by relevance
+type KindSearchRequest struct {
+	Text string `json:"text"`
+	TextOptions
+	Kinds  []string `json:"kinds"`  //empty searches all configured resource kinds
+	Rights string   `json:"rights"` //default "r"
+	Limit  int      `json:"limit"`  //default 10
+	Offset int      `json:"offset"`
+	Fields []string `json:"fields"` //features to return of all kinds; id, creator and permissions are always returned
+}
+
+type KindHit struct {
+	Kind  string                 `json:"kind"`
+	Score float64                `json:"score"`
+	Item  map[string]interface{} `json:"item"`
+}
+
+type KindSearchPage struct {
+	Items  []KindHit `json:"items"`
+	Total  int64     `json:"total"`
+	Limit  int       `json:"limit"`
+	Offset int       `json:"offset"`
+}
+
+func (this KindSearchRequest) Validate() error {
+	if strings.TrimSpace(this.Text) == "" {
+		return errors.New("missing text")
+	}
+	for _, kind := range this.Kinds {
+		if _, ok := Config.Resources[kind]; !ok {
+			return errors.New("unknown resource kind " + kind)
+		}
+	}
+	if this.Rights != "" {
+		if err := validateRights(this.Rights); err != nil {
+			return err
+		}
+	}
+	if this.Limit < 0 || this.Offset < 0 {
+		return errors.New("limit and offset must not be negative")
+	}
+	return this.TextOptions.Validate()
+}
+
+// SearchKinds searches the text in all requested kinds with one query; the hits are ordered by score and tagged with their kind
+func SearchKinds(user string, groups []string, request KindSearchRequest) (page KindSearchPage, err error) {
+	kinds := request.Kinds
+	if len(kinds) == 0 {
+		kinds = append([]string{}, Config.ResourceList...)
+		sort.Strings(kinds)
+	}
+	rights := request.Rights
+	if rights == "" {
+		rights = "r"
+	}
+	query := SearchQuery{Rights: rights, User: user, Groups: groups, Text: request.Text, TextOptions: request.TextOptions, Limit: request.Limit, Offset: request.Offset}
+	if request.Fields != nil {
+		query.Projection = QueryRequest{Fields: request.Fields}.projection("")
+	}
+	resp, err := GetStorage().SearchKinds(context.Background(), kinds, query)
+	if err != nil {
+		return page, err
+	}
+	page.Items = []KindHit{}
+	for _, hit := range resp.Hits {
+		items := toFeatureList([]Entry{hit.Entry}, user, groups)
+		page.Items = append(page.Items, KindHit{Kind: hit.Kind, Score: hit.Score, Item: items[0]})
+	}
+	page.Total = resp.Total
+	page.Offset = request.Offset
+	page.Limit = request.Limit
+	if page.Limit <= 0 {
+		page.Limit = defaultSearchSize
+	}
+	return
+}
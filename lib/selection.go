@@ -18,12 +18,13 @@ package lib
 
 import (
 	"errors"
-
-	"reflect"
+	"fmt"
+	"regexp"
 	"strings"
+	"unicode"
 
-	"github.com/olivere/elastic"
 	"github.com/SmartEnergyPlatform/jwt-http-router"
+	"github.com/olivere/elastic"
 )
 
 type QueryOperationType string
@@ -32,8 +33,29 @@ const (
 	QueryEqualOperation             QueryOperationType = "=="
 	QueryUnequalOperation           QueryOperationType = "!="
 	QueryAnyValueInFeatureOperation QueryOperationType = "any_value_in_feature"
+	QueryLessOperation              QueryOperationType = "<"
+	QueryLessEqualOperation         QueryOperationType = "<="
+	QueryGreaterOperation           QueryOperationType = ">"
+	QueryGreaterEqualOperation      QueryOperationType = ">="
+	QueryBetweenOperation           QueryOperationType = "between"
+	QueryPrefixOperation            QueryOperationType = "prefix"
+	QueryWildcardOperation          QueryOperationType = "wildcard"
+	QueryRegexpOperation            QueryOperationType = "regexp"
+	QueryExistsOperation            QueryOperationType = "exists"
+	QueryNotExistsOperation         QueryOperationType = "not_exists"
 )
 
+var numericMappingTypes = map[string]bool{
+	"long":         true,
+	"integer":      true,
+	"short":        true,
+	"byte":         true,
+	"double":       true,
+	"float":        true,
+	"half_float":   true,
+	"scaled_float": true,
+}
+
 type ConditionConfig struct {
 	Feature   string             `json:"feature"`
 	Operation QueryOperationType `json:"operation"`
@@ -42,16 +64,25 @@ type ConditionConfig struct {
 }
 
 type Selection struct {
-	And       []Selection     `json:"and"`
-	Or        []Selection     `json:"or"`
-	Condition ConditionConfig `json:"condition"`
+	And                []Selection      `json:"and"`
+	Or                 []Selection      `json:"or"`
+	MinimumShouldMatch int              `json:"minimum_should_match"` //number of Or elements that have to match; 0 and 1 mean any
+	Not                *Selection       `json:"not"`
+	Nested             *NestedSelection `json:"nested"`
+	Condition          ConditionConfig  `json:"condition"`
+}
+
+// NestedSelection matches if one element of the array Path matches Selection as a whole; Path has to be mapped as nested
+type NestedSelection struct {
+	Path      string    `json:"path"`
+	Selection Selection `json:"selection"`
 }
 
-func (this Selection) GetFilter(jwt jwt_http_router.Jwt) (result elastic.Query, err error) {
+func (this Selection) GetFilter() (result elastic.Query, err error) {
 	if len(this.And) > 0 {
 		and := []elastic.Query{}
 		for _, sub := range this.And {
-			andElement, err := sub.GetFilter(jwt)
+			andElement, err := sub.GetFilter()
 			if err != nil {
 				return result, err
 			}
@@ -63,28 +94,285 @@ func (this Selection) GetFilter(jwt jwt_http_router.Jwt) (result elastic.Query,
 	if len(this.Or) > 0 {
 		or := []elastic.Query{}
 		for _, sub := range this.Or {
-			orElement, err := sub.GetFilter(jwt)
+			orElement, err := sub.GetFilter()
 			if err != nil {
 				return result, err
 			}
 			or = append(or, orElement)
 		}
-		result = elastic.NewBoolQuery().Should(or...)
+		query := elastic.NewBoolQuery().Should(or...)
+		if this.MinimumShouldMatch > 1 {
+			query = query.MinimumNumberShouldMatch(this.MinimumShouldMatch)
+		}
+		result = query
 		return
 	}
-	return this.Condition.GetFilter(jwt)
+	if this.Not != nil {
+		not, err := this.Not.GetFilter()
+		if err != nil {
+			return result, err
+		}
+		return elastic.NewBoolQuery().MustNot(not), nil
+	}
+	if this.Nested != nil {
+		nested, err := this.Nested.Selection.GetFilter()
+		if err != nil {
+			return result, err
+		}
+		return elastic.NewNestedQuery(this.Nested.Path, elastic.NewBoolQuery().Filter(nested)), nil
+	}
+	return this.Condition.GetFilter()
 }
 
-func (this ConditionConfig) GetFilter(jwt jwt_http_router.Jwt) (elastic.Query, error) {
-	val := this.Value
-	if val == nil || val == "" {
+// Resolve returns a copy of the selection where all conditions with a ref use the value from the jwt
+func (this Selection) Resolve(jwt jwt_http_router.Jwt) (result Selection) {
+	for _, sub := range this.And {
+		result.And = append(result.And, sub.Resolve(jwt))
+	}
+	for _, sub := range this.Or {
+		result.Or = append(result.Or, sub.Resolve(jwt))
+	}
+	result.MinimumShouldMatch = this.MinimumShouldMatch
+	if this.Not != nil {
+		not := this.Not.Resolve(jwt)
+		result.Not = &not
+	}
+	if this.Nested != nil {
+		result.Nested = &NestedSelection{Path: this.Nested.Path, Selection: this.Nested.Selection.Resolve(jwt)}
+	}
+	result.Condition = this.Condition.Resolve(jwt)
+	return
+}
+
+// Validate checks the operations of all conditions and their values against the ElasticMapping of the kind
+func (this Selection) Validate(kind string) (err error) {
+	if len(this.And) > 0 {
+		for _, sub := range this.And {
+			if err = sub.Validate(kind); err != nil {
+				return
+			}
+		}
+		return
+	}
+	if len(this.Or) > 0 {
+		if this.MinimumShouldMatch < 0 || this.MinimumShouldMatch > len(this.Or) {
+			return errors.New("minimum_should_match has to be between 0 and the number of or elements")
+		}
+		for _, sub := range this.Or {
+			if err = sub.Validate(kind); err != nil {
+				return
+			}
+		}
+		return
+	}
+	if this.Not != nil {
+		return this.Not.Validate(kind)
+	}
+	if this.Nested != nil {
+		if mappingType, _ := fieldType(kind, this.Nested.Path); mappingType != "nested" {
+			return errors.New("nested path " + this.Nested.Path + " is not mapped as nested in the ElasticMapping of " + kind)
+		}
+		return this.Nested.Selection.Validate(kind)
+	}
+	return this.Condition.Validate(kind)
+}
+
+func (this ConditionConfig) Resolve(jwt jwt_http_router.Jwt) ConditionConfig {
+	if this.Value == nil || this.Value == "" {
 		switch this.Ref {
 		case "jwt.user":
-			val = jwt.UserId
+			this.Value = jwt.UserId
 		case "jwt.groups":
-			val = jwt.RealmAccess.Roles
+			this.Value = jwt.RealmAccess.Roles
+		}
+	}
+	return this
+}
+
+func (this ConditionConfig) Validate(kind string) error {
+	switch this.Operation {
+	case QueryEqualOperation, QueryUnequalOperation, QueryAnyValueInFeatureOperation:
+		return nil
+	}
+	mappingType, known := fieldType(kind, this.Feature)
+	switch this.Operation {
+	case QueryExistsOperation, QueryNotExistsOperation:
+		if !known {
+			return errors.New("feature " + this.Feature + " is not in the ElasticMapping of " + kind)
+		}
+		return nil
+	case QueryLessOperation, QueryLessEqualOperation, QueryGreaterOperation, QueryGreaterEqualOperation:
+		if !known {
+			return errors.New("feature " + this.Feature + " is not in the ElasticMapping of " + kind)
+		}
+		return validateRangeValue(this.Feature, mappingType, this.Value)
+	case QueryBetweenOperation:
+		if !known {
+			return errors.New("feature " + this.Feature + " is not in the ElasticMapping of " + kind)
+		}
+		values, err := this.valueList()
+		if err != nil || len(values) != 2 {
+			return errors.New("between on " + this.Feature + " expects a list of two values")
+		}
+		for _, value := range values {
+			if err = validateRangeValue(this.Feature, mappingType, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	case QueryPrefixOperation, QueryWildcardOperation, QueryRegexpOperation:
+		if !known {
+			return errors.New("feature " + this.Feature + " is not in the ElasticMapping of " + kind)
+		}
+		if mappingType != "keyword" {
+			return errors.New(string(this.Operation) + " is only supported for keyword features; " + this.Feature + " is " + mappingType)
+		}
+		value, ok := this.Value.(string)
+		if !ok || value == "" {
+			return errors.New(string(this.Operation) + " on " + this.Feature + " expects a string value")
+		}
+		if this.Operation == QueryRegexpOperation {
+			if err := validateRegexp(value); err != nil {
+				return errors.New("invalid regexp for " + this.Feature + ": " + err.Error())
+			}
+		}
+		return nil
+	}
+	return errors.New("unknown query opperation type " + string(this.Operation))
+}
+
+// regexpReserved are characters with a special meaning in lucene regular expressions (all optional operators) or go regexp
+// outside of the common subset; they have to be escaped
+const regexpReserved = "^$@&~<>#\""
+
+var regexpRepetition = regexp.MustCompile(`^\{[0-9]+(,[0-9]*)?\}$`)
+
+// validateRegexp accepts the subset of regular expressions with the same meaning for elasticsearch (lucene syntax)
+// and the memory storage (go regexp): characters, ".", "*", "+", "?", "{n}", "{n,}", "{n,m}", "|", groups
+// and character classes with ranges and negation. "\\" only escapes punctuation.
+func validateRegexp(pattern string) error {
+	runes := []rune(pattern)
+	//last is the last operator, '(' or '|', or 0 after an expression; lucene expects an expression after both and at the start
+	last := '('
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\\':
+			if !regexpEscapable(runes, i) {
+				return errors.New("only punctuation may be escaped with \\")
+			}
+			i++
+		case r == '[':
+			end, err := regexpClassEnd(runes, i)
+			if err != nil {
+				return err
+			}
+			i = end
+		case r == '(':
+			last = r
+			continue
+		case r == '|' || r == ')':
+			if last == '|' || r == '|' && last == '(' {
+				return errors.New("empty alternative")
+			}
+			if r == '|' {
+				last = r
+				continue
+			}
+		case r == '*' || r == '+' || r == '?' || r == '{':
+			if last != 0 {
+				return fmt.Errorf("missing expression before %c", r)
+			}
+			if r == '{' {
+				end := i
+				for end < len(runes) && runes[end] != '}' {
+					end++
+				}
+				if end == len(runes) || !regexpRepetition.MatchString(string(runes[i:end+1])) {
+					return errors.New("{ has to start a repetition like {2}, {2,} or {2,5}")
+				}
+				i = end
+			}
+		case strings.ContainsRune(regexpReserved, r):
+			return fmt.Errorf("%c has to be escaped", r)
+		}
+		last = 0
+	}
+	if last == '|' {
+		return errors.New("empty alternative")
+	}
+	//the structure (groups, repetition limits) is checked by go
+	_, err := regexp.Compile(pattern)
+	return err
+}
+
+func regexpEscapable(runes []rune, escape int) bool {
+	next := escape + 1
+	return next < len(runes) && runes[next] <= unicode.MaxASCII && (unicode.IsPunct(runes[next]) || unicode.IsSymbol(runes[next]))
+}
+
+// regexpClassEnd returns the index of the "]" closing the character class starting at start
+func regexpClassEnd(runes []rune, start int) (int, error) {
+	i := start + 1
+	if i < len(runes) && runes[i] == '^' {
+		i++
+	}
+	if i < len(runes) && runes[i] == ']' {
+		return 0, errors.New("empty character class")
+	}
+	for ; i < len(runes); i++ {
+		switch runes[i] {
+		case ']':
+			return i, nil
+		case '[':
+			return 0, errors.New("[ has to be escaped in a character class")
+		case '\\':
+			if !regexpEscapable(runes, i) {
+				return 0, errors.New("only punctuation may be escaped with \\")
+			}
+			i++
 		}
 	}
+	return 0, errors.New("missing ]")
+}
+
+func validateRangeValue(feature string, mappingType string, value interface{}) error {
+	switch {
+	case numericMappingTypes[mappingType]:
+		if _, ok := toFloat(value); ok {
+			return nil
+		}
+		return errors.New("expect number value for " + feature)
+	case mappingType == "date":
+		if _, ok := parseDate(value); ok {
+			return nil
+		}
+		return errors.New("expect date value for " + feature)
+	case mappingType == "keyword":
+		if _, ok := value.(string); ok {
+			return nil
+		}
+		return errors.New("expect string value for " + feature)
+	}
+	return errors.New("range operations are not supported for " + feature + " of type " + mappingType)
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+func (this ConditionConfig) GetFilter() (elastic.Query, error) {
+	val := this.Value
 	switch this.Operation {
 	case QueryEqualOperation:
 		if val == nil || val == "" {
@@ -99,14 +387,46 @@ func (this ConditionConfig) GetFilter(jwt jwt_http_router.Jwt) (elastic.Query, e
 			return elastic.NewBoolQuery().MustNot(elastic.NewTermQuery(this.Feature, val)), nil
 		}
 	case QueryAnyValueInFeatureOperation:
-		if reflect.TypeOf(val).Kind() == reflect.String {
-			val = strings.Split(val.(string), ",")
-		}
-		arr, err := InterfaceSlice(val)
+		arr, err := this.valueList()
 		if err != nil {
 			return nil, err
 		}
 		return elastic.NewTermsQuery(this.Feature, arr...), nil
+	case QueryLessOperation:
+		return elastic.NewRangeQuery(this.Feature).Lt(val), nil
+	case QueryLessEqualOperation:
+		return elastic.NewRangeQuery(this.Feature).Lte(val), nil
+	case QueryGreaterOperation:
+		return elastic.NewRangeQuery(this.Feature).Gt(val), nil
+	case QueryGreaterEqualOperation:
+		return elastic.NewRangeQuery(this.Feature).Gte(val), nil
+	case QueryBetweenOperation:
+		arr, err := this.valueList()
+		if err != nil {
+			return nil, err
+		}
+		if len(arr) != 2 {
+			return nil, errors.New("between on " + this.Feature + " expects a list of two values")
+		}
+		return elastic.NewRangeQuery(this.Feature).Gte(arr[0]).Lte(arr[1]), nil
+	case QueryPrefixOperation:
+		return elastic.NewPrefixQuery(this.Feature, fmt.Sprint(val)), nil
+	case QueryWildcardOperation:
+		return elastic.NewWildcardQuery(this.Feature, fmt.Sprint(val)), nil
+	case QueryRegexpOperation:
+		return elastic.NewRegexpQuery(this.Feature, fmt.Sprint(val)), nil
+	case QueryExistsOperation:
+		return elastic.NewExistsQuery(this.Feature), nil
+	case QueryNotExistsOperation:
+		return elastic.NewBoolQuery().MustNot(elastic.NewExistsQuery(this.Feature)), nil
 	}
 	return nil, errors.New("unknown query opperation type " + string(this.Operation))
 }
+
+func (this ConditionConfig) valueList() (result []interface{}, err error) {
+	val := this.Value
+	if str, ok := val.(string); ok {
+		val = strings.Split(str, ",")
+	}
+	return InterfaceSlice(val)
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrNotFound = errors.New("not found")
+var ErrVersionConflict = errors.New("version conflict")
+
+type Storage interface {
+	Exists(ctx context.Context, kind string, resource string) (bool, error)
+	Get(ctx context.Context, kind string, resource string) (entry Entry, version Version, err error)
+	// Put stores the entry; a set version is checked against the stored one (ErrVersionConflict on mismatch)
+	Put(ctx context.Context, kind string, entry Entry, version Version) error
+	// Create stores a new entry; ErrVersionConflict if the resource already exists
+	Create(ctx context.Context, kind string, entry Entry) error
+	// Delete removes the entry; a set version is checked against the stored one like in Put
+	Delete(ctx context.Context, kind string, resource string, version Version) error
+	Search(ctx context.Context, kind string, query SearchQuery) (SearchResult, error)
+	Export(ctx context.Context, kind string, limit int, offset int) ([]Entry, error)
+	// Scroll passes every entry matching the query in the order of Sort in batches to handler;
+	// all batches are read from one consistent snapshot; Limit, Offset and After are ignored
+	Scroll(ctx context.Context, kind string, query SearchQuery, batchSize int, handler func([]VersionedEntry) error) error
+	// PutBulk stores the entries like Put and returns the resources rejected by a version conflict
+	PutBulk(ctx context.Context, kind string, entries []VersionedEntry) (conflicts []string, err error)
+	// Facets counts the feature values of all entries matching the query; the result is keyed by Facet.Feature
+	Facets(ctx context.Context, kind string, query SearchQuery, facets []Facet) (map[string][]FacetBucket, error)
+	// SearchKinds searches all kinds in one request ordered by relevance; Sort and After are ignored
+	SearchKinds(ctx context.Context, kinds []string, query SearchQuery) (KindSearchResult, error)
+
+	PutDeadLetter(ctx context.Context, letter DeadLetter) error
+	GetDeadLetter(ctx context.Context, id string) (DeadLetter, error)
+	// ListDeadLetters returns the dead letters ordered by time, oldest first
+	ListDeadLetters(ctx context.Context, limit int, offset int) ([]DeadLetter, error)
+	DeleteDeadLetter(ctx context.Context, id string) error
+
+	// GetState decodes the json state of the service stored with the key into value; ErrNotFound if there is none
+	GetState(ctx context.Context, key string, value interface{}) error
+	PutState(ctx context.Context, key string, value interface{}) error
+}
+
+// Version identifies the stored revision of an entry for optimistic locking; writes with the zero Version are not checked.
+// Number is the sequence number (_seq_no) if PrimaryTerm is set (elasticsearch 7 and newer),
+// otherwise the version of the entry (memory storage, elasticsearch 6).
+type Version struct {
+	Number      int64
+	PrimaryTerm int64
+}
+
+func (this Version) IsSet() bool {
+	return this.Number > 0 || this.PrimaryTerm > 0
+}
+
+type VersionedEntry struct {
+	Entry   Entry
+	Version Version
+}
+
+type KindEntry struct {
+	Kind  string
+	Score float64
+	Entry Entry
+}
+
+type KindSearchResult struct {
+	Total int64
+	Hits  []KindEntry
+}
+
+// SearchQuery describes a rights filtered search; empty fields are not used as filter
+type SearchQuery struct {
+	Rights      string
+	User        string
+	Groups      []string
+	Ids         []string //nil matches every resource, an empty list matches none
+	Text        string
+	TextOptions TextOptions
+	TextFeature string     //feature matched by Text instead of feature_search
+	Selection   *Selection //refs have to be resolved
+	Sort        []SortKey  //ordered by resource id without keys, or by relevance first for text searches
+	Limit       int        //0 uses the default size of the storage (10)
+	Offset      int
+	After       []interface{} //sort values of the last hit of the previous page (search_after); requires Offset 0
+	Projection  *Projection   //nil loads all features
+}
+
+// Projection restricts the features loaded for the hits of a search; resource, creator and rights are always loaded
+type Projection struct {
+	Includes []string `json:"includes"` //feature names or dotted paths; empty loads all features
+	Excludes []string `json:"excludes"`
+}
+
+type SearchResult struct {
+	Total int64
+	Hits  []Entry
+	Next  []interface{} //sort values of the last hit, usable as SearchQuery.After for the following page
+}
+
+// sort keys which do not refer to features
+const (
+	idSortKey      = "id"
+	creatorSortKey = "creator"
+	scoreSortKey   = "_score"
+)
+
+// defaultScrollBatchSize is used if Config.ScrollBatchSize is not set
+const defaultScrollBatchSize = 100
+
+func scrollBatchSize() int {
+	if Config.ScrollBatchSize > 0 {
+		return int(Config.ScrollBatchSize)
+	}
+	return defaultScrollBatchSize
+}
+
+// defaultSearchSize is the number of hits returned by elasticsearch if no limit is given
+const defaultSearchSize = 10
+
+// SortKey orders by a feature, which may have field.subfield syntax, or by "id", "creator" or the relevance "_score";
+// Direction is "asc" (default) or "desc"
+type SortKey struct {
+	Feature   string `json:"feature"`
+	Direction string `json:"direction"`
+}
+
+func (this SortKey) asc() bool {
+	return this.Direction != "desc"
+}
+
+func sortBy(feature string, asc bool) []SortKey {
+	if feature == "" {
+		return nil
+	}
+	if asc {
+		return []SortKey{{Feature: feature, Direction: "asc"}}
+	}
+	return []SortKey{{Feature: feature, Direction: "desc"}}
+}
+
+type sortField struct {
+	field     string
+	asc       bool
+	lowercase bool //sort by the sub-field with the lowercase normalizer (lowercase_sort mapping option)
+}
+
+func (this SortKey) sortField(kind string) sortField {
+	switch this.Feature {
+	case idSortKey:
+		return sortField{field: "resource", asc: this.asc()}
+	case creatorSortKey:
+		return sortField{field: "creator", asc: this.asc()}
+	case scoreSortKey, "score":
+		return sortField{field: scoreSortKey, asc: this.asc()}
+	}
+	return sortField{field: "features." + this.Feature, asc: this.asc(), lowercase: lowercaseSorted(kind, this.Feature)}
+}
+
+// sortFields returns the fields a search is ordered by; the resource id is always last to get a stable order for search_after
+func (this SearchQuery) sortFields(kind string) (result []sortField) {
+	for _, key := range this.Sort {
+		result = append(result, key.sortField(kind))
+	}
+	if len(this.Sort) == 0 && this.Text != "" {
+		result = append(result, sortField{field: scoreSortKey, asc: false})
+	}
+	return append(result, sortField{field: "resource", asc: true})
+}
+
+var storage Storage
+var storageMux sync.Mutex
+
+func GetStorage() Storage {
+	storageMux.Lock()
+	defer storageMux.Unlock()
+	if storage == nil {
+		storage = createStorage()
+	}
+	return storage
+}
+
+// SetStorage replaces the storage used by the package; for example with NewMemoryStorage() in tests
+func SetStorage(s Storage) {
+	storageMux.Lock()
+	defer storageMux.Unlock()
+	storage = s
+}
+
+func createStorage() Storage {
+	switch Config.Storage {
+	case "memory":
+		return NewMemoryStorage()
+	default:
+		return NewElasticStorage(GetClient())
+	}
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"context"
+	"sort"
+)
+
+// NdjsonMediaType may be requested in the Accept header of full-list routes and /export to stream newline delimited json
+const NdjsonMediaType = "application/x-ndjson"
+
+// ExportLine is one line of a streamed export
+type ExportLine struct {
+	Kind string `json:"kind"`
+	ResourceRights
+}
+
+// StreamQuery passes every feature matching the request to handler while scrolling the storage; Limit, Offset and Cursor are ignored.
+// The scroll stops with the error of ctx if ctx is done, for example when the client disconnects.
+func StreamQuery(ctx context.Context, kind string, user string, groups []string, request QueryRequest, handler func(map[string]interface{}) error) (err error) {
+	return scrollFeatures(ctx, kind, request.searchQuery(kind, user, groups), func(items []map[string]interface{}) error {
+		for _, item := range items {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := handler(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// scrollFeatures passes the features of all entries matching the query in batches of Config.ScrollBatchSize to handler
+func scrollFeatures(ctx context.Context, kind string, query SearchQuery, handler func([]map[string]interface{}) error) (err error) {
+	if query.Text != "" && Config.Resources[kind].SearchFallbackFeature != "" {
+		//find out if the text has to be matched against the fallback feature
+		probe := query
+		probe.Limit = 1
+		_, probe, err = searchWithFallback(ctx, kind, probe)
+		if err != nil {
+			return err
+		}
+		query.TextFeature = probe.TextFeature
+	}
+	return GetStorage().Scroll(ctx, kind, query, scrollBatchSize(), func(batch []VersionedEntry) error {
+		entries := []Entry{}
+		for _, element := range batch {
+			entries = append(entries, element.Entry)
+		}
+		items := toFeatureList(entries, query.User, query.Groups)
+		return handler(items)
+	})
+}
+
+// StreamExport passes every entry of all resource kinds to handler while scrolling the storage
+func StreamExport(ctx context.Context, handler func(ExportLine) error) error {
+	kinds := append([]string{}, Config.ResourceList...)
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		err := GetStorage().Scroll(ctx, kind, SearchQuery{}, scrollBatchSize(), func(batch []VersionedEntry) error {
+			for _, element := range batch {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				if err := handler(ExportLine{Kind: kind, ResourceRights: element.Entry.ToResourceRights()}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
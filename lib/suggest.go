@@ -0,0 +1,115 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const maxSuggestSize = 100
+
+// Suggestion is a feature value of a resource matching the typed text
+type Suggestion struct {
+	Id      string `json:"id"`
+	Feature string `json:"feature"`
+	Value   string `json:"value"`
+}
+
+// Suggest returns the best matching searchable feature value of the top size resources the user or groups have the rights for.
+// The edge_ngram analyzed feature_search is used instead of a completion suggester, because completion suggesters can not be filtered by rights.
+func Suggest(kind string, user string, groups []string, rights string, text string, size int) (result []Suggestion, err error) {
+	result = []Suggestion{}
+	if err = validateSuggest(kind, rights, size); err != nil {
+		return result, err
+	}
+	tokens := tokenize(text)
+	if len(tokens) == 0 {
+		return result, nil
+	}
+	paths := searchFeaturePaths("features", Config.ElasticMapping[kind])
+	if len(paths) == 0 {
+		return result, nil
+	}
+	sort.Strings(paths)
+	features := []string{}
+	for _, path := range paths {
+		features = append(features, strings.TrimPrefix(path, "features."))
+	}
+	resp, err := GetStorage().Search(context.Background(), kind, SearchQuery{
+		Rights:     rights,
+		User:       user,
+		Groups:     groups,
+		Text:       text,
+		Limit:      size,
+		Projection: &Projection{Includes: features},
+	})
+	if err != nil {
+		return result, err
+	}
+	for _, entry := range resp.Hits {
+		doc, err := entryToDocument(entry)
+		if err != nil {
+			return result, err
+		}
+		best := Suggestion{}
+		bestScore := 0
+		for i, path := range paths {
+			for _, value := range documentValues(doc, path) {
+				str := fmt.Sprint(value)
+				if score := suggestScore(tokens, str); score > bestScore {
+					best = Suggestion{Id: entry.Resource, Feature: features[i], Value: str}
+					bestScore = score
+				}
+			}
+		}
+		if bestScore > 0 {
+			result = append(result, best)
+		}
+	}
+	return result, nil
+}
+
+func validateSuggest(kind string, rights string, size int) error {
+	if _, ok := Config.Resources[kind]; !ok {
+		return errors.New("unknown resource kind " + kind)
+	}
+	if err := validateRights(rights); err != nil {
+		return err
+	}
+	if size < 0 || size > maxSuggestSize {
+		return fmt.Errorf("size has to be between 0 and %d", maxSuggestSize)
+	}
+	return nil
+}
+
+// suggestScore counts the typed tokens which are a prefix of a token of the value
+func suggestScore(tokens []string, value string) (score int) {
+	valueTokens := tokenize(value)
+	for _, token := range tokens {
+		for _, valueToken := range valueTokens {
+			if strings.HasPrefix(valueToken, token) {
+				score++
+				break
+			}
+		}
+	}
+	return
+}
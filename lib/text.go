@@ -0,0 +1,252 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/olivere/elastic"
+)
+
+const (
+	TextMatchMode  = "match"
+	TextPhraseMode = "phrase"
+	TextPrefixMode = "prefix"
+)
+
+const FuzzinessAuto = "AUTO"
+
+// TextOptions change how the Text of a search is matched against feature_search; the zero value is a plain match
+type TextOptions struct {
+	Mode      string `json:"mode"`      //TextMatchMode (default), TextPhraseMode or TextPrefixMode
+	Fuzziness string `json:"fuzziness"` //FuzzinessAuto or an edit distance of 0, 1 or 2; only for TextMatchMode
+	Highlight bool   `json:"highlight"` //adds the matching fragments per feature to the result
+}
+
+func (this TextOptions) Validate() error {
+	switch this.Mode {
+	case "", TextMatchMode:
+	case TextPhraseMode, TextPrefixMode:
+		if this.Fuzziness != "" {
+			return errors.New("fuzziness is only supported in mode " + TextMatchMode)
+		}
+	default:
+		return errors.New("unknown text mode " + this.Mode)
+	}
+	if this.Fuzziness != "" && this.Fuzziness != FuzzinessAuto {
+		if distance, err := strconv.Atoi(this.Fuzziness); err != nil || distance < 0 || distance > 2 {
+			return errors.New("fuzziness has to be " + FuzzinessAuto + ", 0, 1 or 2")
+		}
+	}
+	return nil
+}
+
+// textOptionsFromUrl reads the TextOptions of the path encoded search routes from the query parameters mode, fuzziness and highlight
+func textOptionsFromUrl(values url.Values) TextOptions {
+	return TextOptions{
+		Mode:      values.Get("mode"),
+		Fuzziness: values.Get("fuzziness"),
+		Highlight: values.Get("highlight") == "true",
+	}
+}
+
+// elasticQuery matches the text against feature_search or, if set, against the feature which is also matched by prefix
+func (this TextOptions) elasticQuery(feature string, text string) elastic.Query {
+	field := "feature_search"
+	if feature != "" {
+		field = "features." + feature
+	}
+	var query elastic.Query
+	switch this.Mode {
+	case TextPhraseMode:
+		query = elastic.NewMatchPhraseQuery(field, text)
+	case TextPrefixMode:
+		query = elastic.NewMatchPhrasePrefixQuery(field, text)
+	default:
+		match := elastic.NewMatchQuery(field, text)
+		if this.Fuzziness != "" {
+			match = match.Fuzziness(this.Fuzziness)
+		}
+		query = match
+	}
+	if feature == "" {
+		return query
+	}
+	return elastic.NewBoolQuery().Should(query, elastic.NewPrefixQuery(field, text))
+}
+
+// maxEdits returns the edit distance allowed for a token; AUTO allows no edit up to 2, one up to 5 and two edits for longer tokens
+func (this TextOptions) maxEdits(token string) int {
+	if this.Fuzziness == FuzzinessAuto {
+		switch length := len([]rune(token)); {
+		case length <= 2:
+			return 0
+		case length <= 5:
+			return 1
+		default:
+			return 2
+		}
+	}
+	distance, _ := strconv.Atoi(this.Fuzziness)
+	return distance
+}
+
+// matchToken checks if the query token matches one of the edge_ngrams of the value token within the allowed edits
+func matchToken(token string, valueToken string, options TextOptions) bool {
+	runes := []rune(valueToken)
+	maxEdits := 0
+	if options.Fuzziness != "" {
+		maxEdits = options.maxEdits(token)
+	}
+	for i := 1; i <= len(runes) && i <= memoryMaxGram; i++ {
+		gram := string(runes[:i])
+		if gram == token || (maxEdits > 0 && editDistance(token, gram) <= maxEdits) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPhrase checks if the query tokens match consecutive value tokens
+func matchPhrase(tokens []string, valueTokens []string, options TextOptions) bool {
+	if len(tokens) == 0 {
+		return false
+	}
+	for start := 0; start+len(tokens) <= len(valueTokens); start++ {
+		match := true
+		for i, token := range tokens {
+			if !matchToken(token, valueTokens[start+i], options) {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// editDistance is the levenshtein distance of the runes of a and b
+func editDistance(a string, b string) int {
+	ar, br := []rune(a), []rune(b)
+	previous := make([]int, len(br)+1)
+	current := make([]int, len(br)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ar); i++ {
+		current[0] = i
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(br)]
+}
+
+func min3(a int, b int, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// highlightFeatures returns for each feature path the values containing a matching word, with the words enclosed in <em></em>;
+// the memory storage equivalent of the highlighter of elasticsearch (see elasticHighlight)
+func highlightFeatures(paths []string, text string, options TextOptions, features map[string]interface{}) (result map[string][]string) {
+	result = map[string][]string{}
+	tokens := tokenize(text)
+	for _, path := range paths {
+		feature := strings.TrimPrefix(path, "features.")
+		for _, value := range documentValues(features, feature) {
+			if fragment, ok := highlightValue(tokens, fmt.Sprint(value), options); ok {
+				result[feature] = append(result[feature], fragment)
+			}
+		}
+	}
+	return result
+}
+
+func highlightValue(tokens []string, value string, options TextOptions) (result string, matched bool) {
+	word := []rune{}
+	flush := func() {
+		if len(word) == 0 {
+			return
+		}
+		for _, token := range tokens {
+			if matchToken(token, strings.ToLower(string(word)), options) {
+				result += "<em>" + string(word) + "</em>"
+				matched = true
+				word = word[:0]
+				return
+			}
+		}
+		result += string(word)
+		word = word[:0]
+	}
+	for _, r := range value {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+			word = append(word, r)
+			continue
+		}
+		flush()
+		result += string(r)
+	}
+	flush()
+	return result, matched
+}
+
+// textPaths returns the paths of the features matched by the text of the query
+func textPaths(kind string, query SearchQuery) []string {
+	if query.TextFeature != "" {
+		return []string{"features." + query.TextFeature}
+	}
+	return searchFeaturePaths("features", Config.ElasticMapping[kind])
+}
+
+// searchWithFallback searches the text in feature_search and falls back to the SearchFallbackFeature of the kind
+// if no feature of the kind is copied to feature_search or feature_search has no hits; the executed query is returned
+func searchWithFallback(ctx context.Context, kind string, query SearchQuery) (result SearchResult, executed SearchQuery, err error) {
+	fallback := Config.Resources[kind].SearchFallbackFeature
+	if query.Text == "" || query.TextFeature != "" || fallback == "" {
+		result, err = GetStorage().Search(ctx, kind, query)
+		return result, query, err
+	}
+	if len(searchFeaturePaths("features", Config.ElasticMapping[kind])) > 0 {
+		result, err = GetStorage().Search(ctx, kind, query)
+		if err != nil || result.Total > 0 {
+			return result, query, err
+		}
+	}
+	query.TextFeature = fallback
+	result, err = GetStorage().Search(ctx, kind, query)
+	return result, query, err
+}
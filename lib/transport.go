@@ -0,0 +1,87 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package lib
+
+import (
+	"sync"
+	"time"
+)
+
+// Transport consumes and publishes the events of the service
+type Transport interface {
+	// Subscribe passes the messages of the topic to handler; a consumer group receives each message once.
+	// If handler returns an error the message is not committed and delivered again.
+	Subscribe(group string, topic string, handler TransportHandler) error
+	Publish(topic string, payload []byte) error
+	Close()
+}
+
+type TransportHandler func(msg []byte) error
+
+// transportRetryPause is the pause before a message is delivered again after its handler failed
+const transportRetryPause = 3 * time.Second
+
+var transport Transport
+var transportMux sync.Mutex
+
+// GetTransport returns the transport selected by Config.Transport and connects it on first use
+func GetTransport() (Transport, error) {
+	transportMux.Lock()
+	defer transportMux.Unlock()
+	if transport == nil {
+		t, err := createTransport()
+		if err != nil {
+			return nil, err
+		}
+		transport = t
+	}
+	return transport, nil
+}
+
+// SetTransport replaces the transport used by the package; for example with NewChannelTransport() in tests
+func SetTransport(t Transport) {
+	transportMux.Lock()
+	defer transportMux.Unlock()
+	transport = t
+}
+
+func createTransport() (Transport, error) {
+	switch Config.Transport {
+	case "kafka":
+		return NewKafkaTransport(Config.KafkaBrokers), nil
+	case "channel":
+		return NewChannelTransport(), nil
+	default:
+		return NewAmqpTransport(Config.AmqpUrl, eventTopics(), Config.AmqpReconnectTimeout)
+	}
+}
+
+// eventTopics returns all topics consumed or published by the service
+func eventTopics() []string {
+	result := append(append([]string{}, Config.ResourceList...), Config.PermTopic, Config.UserTopic)
+	if Config.DeadLetterTopic != "" {
+		result = append(result, Config.DeadLetterTopic)
+	}
+	if Config.NotificationTopic != "" {
+		result = append(result, Config.NotificationTopic)
+	}
+	return result
+}
+
+// consumerGroup returns the name of the queue or consumer group of the service for the topic
+func consumerGroup(topic string) string {
+	return Config.AmqpConsumerName + "_" + topic
+}
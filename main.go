@@ -17,7 +17,9 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"time"
 
@@ -26,19 +28,47 @@ import (
 
 func main() {
 	configLocation := flag.String("config", "config.json", "configuration file")
+	migrate := flag.Bool("migrate", false, "migrate indices with changed ElasticMapping to a new index version and exit")
+	reconcileDryRun := flag.Bool("reconcile-dry-run", false, "print the entries per resource kind affected by a reconciliation of InitialGroupRights and exit")
 	flag.Parse()
 
 	err := lib.LoadConfig(*configLocation)
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	if *migrate {
+		err = lib.MigrateMappings()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *reconcileDryRun {
+		report, err := lib.ReconcileInitialGroupRights(true)
+		if err != nil {
+			log.Fatal(err)
+		}
+		result, _ := json.MarshalIndent(report, "", "    ")
+		fmt.Println(string(result))
+		return
+	}
+
 	time.Sleep(time.Duration(lib.Config.AmqpReconnectTimeout) * time.Second)
 
 	if lib.Config.DbInitOnly == "true" {
-		lib.GetClient()
+		lib.GetStorage()
 	} else {
-		if lib.Config.InitialGroupRightsUpdate == "true" {
-			lib.UpdateInitialGroupRights()
+		switch lib.Config.InitialGroupRightsUpdate {
+		case "true":
+			if _, err := lib.UpdateInitialGroupRights(); err != nil {
+				log.Fatal("ERROR: unable to update initial group rights ", err)
+			}
+		case "reconcile":
+			if _, err := lib.ReconcileInitialGroupRights(false); err != nil {
+				log.Fatal("ERROR: unable to reconcile initial group rights ", err)
+			}
 		}
 		if lib.Config.ConsumptionPause == "true" {
 			log.Println("pause event consumption")